@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// A urlChange is a URL rewritten by 'adopt' in a git config file: Config holds the new value.
+type urlChange struct {
+	Config *git.GitConfig
+	Old    string
+}
+
+func adopt(cmd *cobra.Command, args []string) {
+	dir := "."
+	if len(args) > 0 {
+		dir = args[0]
+	}
+
+	changes, err := collectURLChanges(dir)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	if len(changes) == 0 {
+		log.Info().Msgf("No URL to rewrite in %s", dir)
+		return
+	}
+
+	if dryRun {
+		printURLChanges(os.Stdout, changes)
+		return
+	}
+
+	gitmodules := false
+	for _, c := range changes {
+		log.Info().Msgf("%s: %s %s -> %s", c.Config.Scope.File, c.Config.Name(), c.Old, c.Config.Value)
+		git.ReplaceConfig(c.Config, c.Old)
+		gitmodules = gitmodules || filepath.Base(c.Config.Scope.File) == ".gitmodules"
+	}
+
+	if gitmodules {
+		log.Info().Msg(".gitmodules has been changed: commit it to share the new URLs, or restore it with 'git checkout .gitmodules'")
+	}
+	if allow, _ := git.ConfigLookup(fmt.Sprintf("protocol.%s.allow", helperProtocol())); !adoptReverse && allow != "always" {
+		log.Warn().Msgf("Submodules using %s:// URLs are refused until you run '%s install'", helperProtocol(), binaryName)
+	}
+}
+
+// collectURLChanges lists the remote, pushurl and submodule URLs to rewrite in the repository of dir,
+// and in its initialized submodules, recursively.
+func collectURLChanges(dir string) ([]*urlChange, error) {
+	var changes []*urlChange
+	err := walkRepos(dir, func(abs string, config, gitmodules *git.ConfigScope) error {
+		for _, scope := range []*git.ConfigScope{config, gitmodules} {
+			if scope == nil {
+				continue
+			}
+			for _, c := range git.ConfigGetRegexpIn(*scope, `^(remote\..*\.(url|pushurl)|submodule\..*\.url)$`) {
+				if rewritten, ok := adoptURL(c.Value); ok {
+					old := c.Value
+					c.Value = rewritten
+					changes = append(changes, &urlChange{Config: c, Old: old})
+				}
+			}
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// walkRepos calls visit for the repository in dir, and for each of its initialized submodules, recursively.
+// visit runs from the directory of the repository, so that its own config applies, and is given
+// the git config file of the repository along with its .gitmodules, if any.
+func walkRepos(dir string, visit func(abs string, config, gitmodules *git.ConfigScope) error) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	gitDir, err := git.GitDir(abs)
+	if err != nil {
+		return err
+	}
+
+	prev, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(abs); err != nil {
+		return err
+	}
+	defer os.Chdir(prev)
+
+	config := &git.ConfigScope{Kind: git.ScopeFile, File: filepath.Join(gitDir, "config")}
+	gitmodules := &git.ConfigScope{Kind: git.ScopeFile, File: filepath.Join(abs, ".gitmodules")}
+	if _, err := os.Stat(gitmodules.File); err != nil {
+		gitmodules = nil
+	}
+	if err := visit(abs, config, gitmodules); err != nil {
+		return err
+	}
+
+	if gitmodules == nil {
+		return nil
+	}
+	for _, c := range git.ConfigGetRegexpIn(*gitmodules, `^submodule\..*\.path$`) {
+		sub := filepath.Join(abs, c.Value)
+		if _, err := os.Stat(filepath.Join(sub, ".git")); err != nil {
+			log.Debug().Msgf("[walkRepos] Skipping submodule %s, which is not initialized", sub)
+			continue
+		}
+		if err := walkRepos(sub, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adoptURL returns the https+iap:// URL of an https:// URL configured for IAP,
+// or the https:// URL of an https+iap:// URL with --reverse.
+func adoptURL(url string) (string, bool) {
+	https, iapURL := "https://", helperProtocol()+"://"
+	if adoptReverse {
+		if !strings.HasPrefix(url, iapURL) {
+			return "", false
+		}
+		return https + strings.TrimPrefix(url, iapURL), true
+	}
+
+	if !strings.HasPrefix(url, https) {
+		return "", false
+	}
+	if err := iap.CheckConfig(url); err != nil {
+		log.Debug().Msgf("[adopt] Skipping %s: %s", url, err)
+		return "", false
+	}
+	return iapURL + strings.TrimPrefix(url, https), true
+}
+
+// printURLChanges shows the changes of 'adopt' as a diff of each git config file.
+func printURLChanges(w io.Writer, changes []*urlChange) {
+	file := ""
+	for _, c := range changes {
+		if c.Config.Scope.File != file {
+			file = c.Config.Scope.File
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", file, file)
+		}
+		fmt.Fprintf(w, "-%s = %s\n+%s = %s\n", c.Config.Name(), c.Old, c.Config.Name(), c.Config.Value)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitIn runs git with args in dir.
+func gitIn(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir, "-c", "protocol.file.allow=always"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newTestRepo creates a repository with a first commit in dir, and an origin remote with url.
+func newTestRepo(t *testing.T, dir, url string) string {
+	t.Helper()
+	gitIn(t, filepath.Dir(dir), "init", "--quiet", dir)
+	gitIn(t, dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "--allow-empty", "-m", "init")
+	if url != "" {
+		gitIn(t, dir, "remote", "add", "origin", url)
+	}
+	return dir
+}
+
+// newTestSuperproject creates a repository with an initialized submodule "sub",
+// both with URLs on the IAP host a.example.com and on another host.
+func newTestSuperproject(t *testing.T, home string) (super string, sub string) {
+	t.Helper()
+	src := newTestRepo(t, filepath.Join(home, "src"), "")
+	super = newTestRepo(t, filepath.Join(home, "super"), "https://a.example.com/group/super.git")
+	gitIn(t, super, "remote", "set-url", "--push", "origin", "https://github.com/group/super.git")
+
+	gitIn(t, super, "submodule", "--quiet", "add", src, "sub")
+	gitIn(t, super, "config", "--file", ".gitmodules", "submodule.sub.url", "https://a.example.com/group/sub.git")
+	gitIn(t, super, "config", "submodule.sub.url", "https://a.example.com/group/sub.git")
+	sub = filepath.Join(super, "sub")
+	gitIn(t, sub, "remote", "set-url", "origin", "https://a.example.com/group/sub.git")
+	return super, sub
+}
+
+// repoURLs returns the remote and submodule URLs of the repository and .gitmodules in dir.
+func repoURLs(t *testing.T, dir string) string {
+	t.Helper()
+	urls := gitIn(t, dir, "config", "--get-regexp", `^(remote\..*\.(url|pushurl)|submodule\..*\.url)$`)
+	if _, err := os.Stat(filepath.Join(dir, ".gitmodules")); err == nil {
+		urls += "\n" + gitIn(t, dir, "config", "--file", ".gitmodules", "--get-regexp", `^submodule\..*\.url$`)
+	}
+	return urls
+}
+
+func setAdoptFlags(t *testing.T, dry, reverse bool) {
+	prevDry, prevReverse := dryRun, adoptReverse
+	dryRun, adoptReverse = dry, reverse
+	t.Cleanup(func() { dryRun, adoptReverse = prevDry, prevReverse })
+}
+
+func TestAdoptURL(t *testing.T) {
+	newTestHome(t)
+	configureTestHost(t, "https://a.example.com", "client-a", "helper-1")
+
+	for _, tc := range []struct {
+		url     string
+		reverse bool
+		want    string
+	}{
+		{"https://a.example.com/group/repo.git", false, "https+iap://a.example.com/group/repo.git"},
+		{"https://github.com/group/repo.git", false, ""},
+		{"https+iap://a.example.com/group/repo.git", false, ""},
+		{"git@a.example.com:group/repo.git", false, ""},
+		{"https+iap://a.example.com/group/repo.git", true, "https://a.example.com/group/repo.git"},
+		{"https://a.example.com/group/repo.git", true, ""},
+	} {
+		setAdoptFlags(t, false, tc.reverse)
+		got, ok := adoptURL(tc.url)
+		if ok != (tc.want != "") || got != tc.want {
+			t.Errorf("adoptURL(%s) with reverse=%t = %q, %t, want %q", tc.url, tc.reverse, got, ok, tc.want)
+		}
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	home := newTestHome(t)
+	configureTestHost(t, "https://a.example.com", "client-a", "helper-1")
+	super, sub := newTestSuperproject(t, home)
+	superURLs, subURLs := repoURLs(t, super), repoURLs(t, sub)
+
+	t.Run("dry run", func(t *testing.T) {
+		setAdoptFlags(t, true, false)
+		changes, err := collectURLChanges(super)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		printURLChanges(&out, changes)
+		for _, want := range []string{
+			"+++ " + filepath.Join(super, ".git", "config"),
+			"-remote.origin.url = https://a.example.com/group/super.git\n+remote.origin.url = https+iap://a.example.com/group/super.git\n",
+			"-submodule.sub.url = https://a.example.com/group/sub.git\n+submodule.sub.url = https+iap://a.example.com/group/sub.git\n",
+			"+++ " + filepath.Join(super, ".gitmodules"),
+			"+++ " + filepath.Join(super, ".git", "modules", "sub", "config"),
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("diff does not contain %q:\n%s", want, out.String())
+			}
+		}
+		if strings.Contains(out.String(), "github.com") {
+			t.Errorf("diff rewrites a URL that is not configured for IAP:\n%s", out.String())
+		}
+
+		adopt(nil, []string{super})
+		if got := repoURLs(t, super); got != superURLs {
+			t.Errorf("--dry-run changed the URLs of the superproject:\n%s\nwant:\n%s", got, superURLs)
+		}
+		if got := repoURLs(t, sub); got != subURLs {
+			t.Errorf("--dry-run changed the URLs of the submodule:\n%s\nwant:\n%s", got, subURLs)
+		}
+	})
+
+	t.Run("adopt", func(t *testing.T) {
+		setAdoptFlags(t, false, false)
+		adopt(nil, []string{super})
+		for _, tc := range []struct{ dir, args, want string }{
+			{super, "remote.origin.url", "https+iap://a.example.com/group/super.git"},
+			{super, "remote.origin.pushurl", "https://github.com/group/super.git"},
+			{super, "submodule.sub.url", "https+iap://a.example.com/group/sub.git"},
+			{super, "--file .gitmodules submodule.sub.url", "https+iap://a.example.com/group/sub.git"},
+			{sub, "remote.origin.url", "https+iap://a.example.com/group/sub.git"},
+		} {
+			if got := gitIn(t, tc.dir, append([]string{"config"}, strings.Fields(tc.args)...)...); got != tc.want {
+				t.Errorf("%s in %s = %q, want %q", tc.args, tc.dir, got, tc.want)
+			}
+		}
+	})
+
+	t.Run("reverse", func(t *testing.T) {
+		setAdoptFlags(t, false, true)
+		adopt(nil, []string{super})
+		if got := repoURLs(t, super); got != superURLs {
+			t.Errorf("--reverse did not restore the URLs of the superproject:\n%s\nwant:\n%s", got, superURLs)
+		}
+		if got := repoURLs(t, sub); got != subURLs {
+			t.Errorf("--reverse did not restore the URLs of the submodule:\n%s\nwant:\n%s", got, subURLs)
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	_url "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+)
+
+// checkRepo refreshes the IAP auth token of every IAP protected URL a repository needs: its remotes,
+// push URLs, submodules and LFS endpoints, before a long git operation starts.
+// URLs sharing a refresh token are refreshed one after the other, so that a single browser login
+// covers them, and the others in parallel. Refreshes that may prompt for a passphrase or open the browser,
+// including the browser logins retrying failed refreshes, are made one at a time.
+// Every URL is tried, and the application exits in case of error once all of them were.
+func checkRepo(dir string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		log.Fatal().Msgf("Could not find %s: %s", dir, err)
+	}
+	urls, err := collectIAPURLs(abs)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	log.Debug().Msgf("[checkRepo] IAP protected URLs of %s: %s", abs, strings.Join(urls, ", "))
+
+	// config local to the repository applies
+	if err := os.Chdir(abs); err != nil {
+		log.Fatal().Msgf("Could not enter %s: %s", abs, err)
+	}
+
+	groups := groupByRefreshToken(urls)
+	var (
+		wg       sync.WaitGroup
+		promptMu sync.Mutex
+		errorsMu sync.Mutex
+		failed   []string
+	)
+	for _, group := range groups {
+		// whether a group prompts is decided before any refresh, as prompting for the passphrase unlocks the store
+		wg.Add(1)
+		go func(urls []string, prompts bool) {
+			defer wg.Done()
+			// groups that may prompt hold the lock throughout, the others take it if they fall back to the browser
+			browser := sync.Locker(&promptMu)
+			if prompts {
+				promptMu.Lock()
+				defer promptMu.Unlock()
+				browser = nil
+			}
+			for _, url := range urls {
+				cookie, err := iapAuthCookieFor(url, forcebrowser, browser)
+				if err != nil {
+					errorsMu.Lock()
+					failed = append(failed, fmt.Sprintf("%s: %s", url, err))
+					errorsMu.Unlock()
+					continue
+				}
+				log.Info().Msgf("IAP auth token for %s valid until %s", url, time.Unix(cookie.Claims.ExpiresAt, 0))
+			}
+		}(group, mayPrompt(group[0]))
+	}
+	wg.Wait()
+
+	for _, f := range failed {
+		log.Error().Msgf("Could not refresh the IAP auth token of %s", f)
+	}
+	if len(failed) > 0 {
+		log.Fatal().Msgf("Could not refresh the IAP auth tokens of %d of the %d IAP protected URLs of %s", len(failed), len(urls), abs)
+	}
+}
+
+// groupByRefreshToken groups URLs by the refresh token they share, that of their helperID and account,
+// keeping a single URL per cookie jar as URLs sharing a jar share their IAP auth token.
+func groupByRefreshToken(urls []string) [][]string {
+	var keys []string
+	groups := map[string][]string{}
+	jars := map[string]bool{}
+	for _, url := range urls {
+		jar := git.ConfigGetURLMatch("http.cookieFile", url)
+		if jar != "" && jars[jar] {
+			continue
+		}
+		jars[jar] = true
+
+		key := fmt.Sprintf("%s/%s", git.ConfigGetURLMatch("iap.helperID", url), iap.Account(url))
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], url)
+	}
+
+	var grouped [][]string
+	for _, key := range keys {
+		grouped = append(grouped, groups[key])
+	}
+	return grouped
+}
+
+// mayPrompt reports whether refreshing the IAP auth token of a URL may prompt for the passphrase
+// of the token store, or open the browser.
+func mayPrompt(url string) bool {
+	if forcebrowser {
+		return true
+	}
+	s := iap.Status(url, git.ConfigGetURLMatch("iap.clientID", url), git.ConfigGetURLMatch("iap.helperID", url),
+		iap.Account(url), git.ConfigGetURLMatch("http.cookieFile", url), false)
+	return s.Locked || s.NeedsLogin || s.Error != ""
+}
+
+// collectIAPURLs returns the https:// URLs configured for IAP among the remotes, push URLs, submodules
+// and LFS endpoints of the repository in dir and of its initialized submodules, recursively.
+func collectIAPURLs(dir string) ([]string, error) {
+	var urls []string
+	add := func(raw string) {
+		if !strings.HasPrefix(raw, "https://") && !strings.HasPrefix(raw, helperProtocol()+"://") {
+			return
+		}
+		https, err := toHTTPSURL(raw)
+		if err != nil || contains(urls, https) {
+			return
+		}
+		if err := iap.CheckConfig(https); err != nil {
+			log.Debug().Msgf("[checkRepo] Skipping %s: %s", raw, err)
+			return
+		}
+		urls = append(urls, https)
+	}
+
+	err := walkRepos(dir, func(abs string, config, gitmodules *git.ConfigScope) error {
+		for _, c := range git.ConfigGetRegexpIn(*config, `^(remote\..*\.(url|pushurl|lfsurl)|submodule\..*\.url)$`) {
+			add(c.Value)
+		}
+		lfsConfigs := []*git.ConfigScope{config}
+		if _, err := os.Stat(filepath.Join(abs, ".lfsconfig")); err == nil {
+			lfsConfig := &git.ConfigScope{Kind: git.ScopeFile, File: filepath.Join(abs, ".lfsconfig")}
+			lfsConfigs = append(lfsConfigs, lfsConfig)
+			for _, c := range git.ConfigGetRegexpIn(*lfsConfig, `^remote\..*\.lfsurl$`) {
+				add(c.Value)
+			}
+		}
+		for _, scope := range lfsConfigs {
+			if lfs := (&git.GitConfig{Section: "lfs", Key: "url", Scope: *scope}); git.ConfigGetIn(lfs) {
+				add(lfs.Value)
+			}
+		}
+
+		if gitmodules == nil {
+			return nil
+		}
+		// relative submodule URLs are relative to the URL of the remote of the current branch, or of origin
+		remote := &git.GitConfig{Section: "remote", Url: "origin", Key: "url", Scope: *config}
+		if branch, err := git.CurrentBranch(abs); err == nil {
+			if b := (&git.GitConfig{Section: "branch", Url: branch, Key: "remote", Scope: *config}); git.ConfigGetIn(b) && b.Value != "." {
+				remote.Url = b.Value
+			}
+		}
+		git.ConfigGetIn(remote)
+		for _, c := range git.ConfigGetRegexpIn(*gitmodules, `^submodule\..*\.url$`) {
+			if strings.HasPrefix(c.Value, "./") || strings.HasPrefix(c.Value, "../") {
+				if base, err := _url.Parse(strings.TrimSuffix(remote.Value, "/") + "/"); err == nil && remote.Value != "" {
+					if rel, err := _url.Parse(c.Value); err == nil {
+						add(base.ResolveReference(rel).String())
+					}
+				}
+				continue
+			}
+			add(c.Value)
+		}
+		return nil
+	})
+	return urls, err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCollectIAPURLs(t *testing.T) {
+	home := newTestHome(t)
+	configureTestHost(t, "https://a.example.com", "client-a", "helper-1")
+	configureTestHost(t, "https://lfs.example.com", "client-lfs", "helper-1")
+	configureTestHost(t, "https://c.example.com", "client-c", "helper-1")
+	gitConfig(t, "--global", "iap.https://c.example.com.account", "work")
+	configureTestHost(t, "https://d.example.com", "client-d", "helper-2")
+
+	repo := newTestRepo(t, filepath.Join(home, "repo"), "https+iap://a.example.com/group/repo.git")
+	gitIn(t, repo, "remote", "add", "upstream", "https://github.com/group/repo.git")
+	gitIn(t, repo, "config", "lfs.url", "https://lfs.example.com/group/repo.git/info/lfs")
+	for _, entry := range [][2]string{
+		{"submodule.sibling.path", "sibling"},
+		{"submodule.sibling.url", "../sibling.git"},
+		{"submodule.sub.path", "sub"},
+		{"submodule.sub.url", "./sub"},
+		{"submodule.other.path", "other"},
+		{"submodule.other.url", "https://github.com/group/other.git"},
+	} {
+		gitIn(t, repo, "config", "--file", ".gitmodules", entry[0], entry[1])
+	}
+	gitIn(t, repo, "config", "--file", ".lfsconfig", "remote.origin.lfsurl", "https://c.example.com/lfs")
+	gitIn(t, repo, "config", "--file", ".lfsconfig", "lfs.url", "https://d.example.com/lfs")
+
+	urls, err := collectIAPURLs(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://a.example.com/group/repo.git",
+		"https://c.example.com/lfs",
+		"https://lfs.example.com/group/repo.git/info/lfs",
+		"https://d.example.com/lfs",
+		"https://a.example.com/group/sibling.git",
+		"https://a.example.com/group/repo.git/sub",
+	}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("collectIAPURLs = %q, want %q", urls, want)
+	}
+
+	// the URLs of a.example.com share their cookie jar, and lfs.example.com the refresh token of helper-1
+	wantGroups := [][]string{
+		{"https://a.example.com/group/repo.git", "https://lfs.example.com/group/repo.git/info/lfs"},
+		{"https://c.example.com/lfs"},
+		{"https://d.example.com/lfs"},
+	}
+	if groups := groupByRefreshToken(urls); !reflect.DeepEqual(groups, wantGroups) {
+		t.Errorf("groupByRefreshToken = %q, want %q", groups, wantGroups)
+	}
+}
+
+func TestCollectIAPURLsBranchRemote(t *testing.T) {
+	home := newTestHome(t)
+	configureTestHost(t, "https://a.example.com", "client-a", "helper-1")
+	configureTestHost(t, "https://b.example.com", "client-b", "helper-1")
+
+	repo := newTestRepo(t, filepath.Join(home, "repo"), "https://a.example.com/group/repo.git")
+	gitIn(t, repo, "remote", "add", "fork", "https+iap://b.example.com/fork/repo.git")
+	branch := gitIn(t, repo, "symbolic-ref", "--short", "HEAD")
+	gitIn(t, repo, "config", "branch."+branch+".remote", "fork")
+	gitIn(t, repo, "config", "--file", ".gitmodules", "submodule.sibling.url", "../sibling.git")
+
+	urls, err := collectIAPURLs(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// relative submodule URLs follow the remote of the current branch
+	want := []string{
+		"https://a.example.com/group/repo.git",
+		"https://b.example.com/fork/repo.git",
+		"https://b.example.com/fork/sibling.git",
+	}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("collectIAPURLs = %q, want %q", urls, want)
+	}
+}
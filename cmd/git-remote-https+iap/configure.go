@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	_url "net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// A hostConfig holds the IAP settings of a repository, as given to 'configure'.
+type hostConfig struct {
+	RepoURL      string
+	HelperID     string
+	HelperSecret string
+	ClientID     string
+	Account      string
+	ScopePath    bool
+	StoreSecret  bool
+	ConfigScope  git.ConfigScope
+}
+
+// A configPlan lists the git config entries written by 'configure' for a hostConfig.
+// Suggestions are entries that cannot be written for the user, such as the ones of wildcard hosts.
+type configPlan struct {
+	Scope       string
+	Entries     []*git.GitConfig
+	Suggestions []*git.GitConfig
+
+	host *hostConfig
+}
+
+func configureIAP(cmd *cobra.Command, args []string) {
+	if discoverURL != "" {
+		configureFromOrg(discoverURL)
+		return
+	}
+
+	var missing []string
+	for _, flag := range []string{"repoURL", "helperID", "helperSecret"} {
+		if !cmd.Flags().Changed(flag) {
+			missing = append(missing, fmt.Sprintf("\"%s\"", flag))
+		}
+	}
+	h := &hostConfig{
+		RepoURL:      repoURL,
+		HelperID:     helperID,
+		HelperSecret: helperSecret,
+		ClientID:     clientID,
+		Account:      account,
+		ScopePath:    scopePath,
+		StoreSecret:  storeSecret,
+		ConfigScope:  parseGitScope(),
+	}
+	if len(missing) > 0 {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			log.Fatal().Msgf("required flag(s) %s not set", strings.Join(missing, ", "))
+		}
+		configureWizard(h)
+		return
+	}
+
+	plan, err := h.plan()
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	plan.apply()
+}
+
+// configureWizard prompts for the settings of h that were not given as flags, shows the git config
+// it is about to write, and tests the login once it is written.
+func configureWizard(h *hostConfig) {
+	in := bufio.NewReader(os.Stdin)
+
+	var scope string
+	for h.RepoURL == "" {
+		h.RepoURL = prompt(in, "URL of the git repository", "")
+		if h.RepoURL != "" && !strings.Contains(h.RepoURL, "://") {
+			h.RepoURL = "https://" + h.RepoURL
+		}
+		var err error
+		if _, scope, err = configScope(h.RepoURL, h.ScopePath); err != nil {
+			fmt.Println(err)
+			h.RepoURL = ""
+		}
+	}
+	if scope == "" {
+		_, scope, _ = configScope(h.RepoURL, h.ScopePath)
+	}
+	fmt.Printf("IAP will be configured for %s, in the %s git config\n", scope, h.ConfigScope)
+
+	for h.HelperID == "" || validateOAuthClientID(h.HelperID) != nil {
+		if h.HelperID != "" {
+			fmt.Println(validateOAuthClientID(h.HelperID))
+		}
+		h.HelperID = prompt(in, "OAuth Client ID for the helper", "")
+	}
+	for h.HelperSecret == "" {
+		h.HelperSecret = promptSecret("OAuth Client Secret for the helper")
+	}
+	// a --clientID flag is validated like the other IDs, and only discovered when it is not set
+	var discovered string
+	if h.ClientID == "" {
+		if probe, err := toHTTPSURL(h.RepoURL); err == nil && !strings.Contains(probe, "*") {
+			discovered, _ = iap.DiscoverClientID(probe)
+		}
+	}
+	for h.ClientID == "" || validateOAuthClientID(h.ClientID) != nil {
+		if h.ClientID != "" {
+			fmt.Println(validateOAuthClientID(h.ClientID))
+		}
+		h.ClientID = prompt(in, "OAuth Client ID of the IAP instance", discovered)
+	}
+
+	plan, err := h.plan()
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	fmt.Println("\nThe following configuration will be written:")
+	plan.print(os.Stdout)
+	if answer := prompt(in, "Proceed? [Y/n]", ""); answer != "" && !strings.HasPrefix(strings.ToLower(answer), "y") {
+		fmt.Println("Aborted, nothing was written")
+		os.Exit(1)
+	}
+	plan.apply()
+
+	fmt.Printf("Testing login to %s...\n", h.RepoURL)
+	cookie := handleIAPAuthCookieFor(h.RepoURL, false)
+	fmt.Printf("Logged in, IAP auth token valid until %s\n", time.Unix(cookie.Claims.ExpiresAt, 0))
+}
+
+// validateOAuthClientID returns an error if id does not look like the ID of a Google OAuth Client.
+func validateOAuthClientID(id string) error {
+	if !strings.HasSuffix(id, ".apps.googleusercontent.com") {
+		return fmt.Errorf("'%s' is not an OAuth Client ID, which ends with .apps.googleusercontent.com", id)
+	}
+	return nil
+}
+
+// prompt reads a line from in, returning def when it is empty.
+func prompt(in *bufio.Reader, label, def string) string {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", label, def)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatal().Msgf("Could not read %s: %s", label, err)
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def
+	}
+	return line
+}
+
+// promptSecret reads a line from the terminal without echoing it.
+func promptSecret(label string) string {
+	fmt.Printf("%s: ", label)
+	defer fmt.Println()
+
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		log.Fatal().Msgf("Could not read %s: %s", label, err)
+	}
+	return strings.TrimSpace(string(secret))
+}
+
+// configureFromOrg configures every host listed in the OrgConfig found at location.
+func configureFromOrg(location string) {
+	org, err := iap.DiscoverOrgConfig(location)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	scope := parseGitScope()
+
+	var plans []*configPlan
+	for _, h := range org.Hosts {
+		plan, err := (&hostConfig{
+			RepoURL:      h.URL,
+			HelperID:     h.HelperID,
+			HelperSecret: h.HelperSecret,
+			ClientID:     h.ClientID,
+			Account:      account,
+			ScopePath:    h.ScopePath,
+			StoreSecret:  storeSecret,
+			ConfigScope:  scope,
+		}).plan()
+		if err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+		plans = append(plans, plan)
+	}
+
+	fmt.Printf("Configuring IAP from %s:\n", location)
+	for _, plan := range plans {
+		plan.print(os.Stdout)
+	}
+	for _, plan := range plans {
+		plan.apply()
+	}
+}
+
+// plan computes the git config entries for a hostConfig, discovering its clientID if needed.
+func (h *hostConfig) plan() (*configPlan, error) {
+	repo, scope, err := configScope(h.RepoURL, h.ScopePath)
+	if err != nil {
+		return nil, err
+	}
+	https := fmt.Sprintf("https://%s", repo.Host)
+
+	if h.ClientID == "" {
+		if strings.Contains(repo.Host, "*") {
+			return nil, fmt.Errorf("The IAP clientID cannot be discovered for wildcard hosts, please set --clientID")
+		}
+		probe, _ := toHTTPSURL(h.RepoURL)
+		h.ClientID, err = iap.DiscoverClientID(probe)
+		if err != nil {
+			return nil, fmt.Errorf("Could not discover the IAP clientID, please set --clientID: %s", err)
+		}
+		fmt.Printf("Discovered IAP clientID for %s: %s\n", scope, h.ClientID)
+	}
+
+	p := &configPlan{Scope: scope, host: h}
+	set := func(section, key, value string) {
+		p.Entries = append(p.Entries, &git.GitConfig{Url: scope, Section: section, Key: key, Value: value, Scope: h.ConfigScope})
+	}
+
+	set("iap", "helperID", h.HelperID)
+	if h.StoreSecret {
+		set("iap", "helperSecret", iap.HelperSecretRefPrefix+h.HelperID)
+	} else {
+		set("iap", "helperSecret", h.HelperSecret)
+	}
+	set("iap", "clientID", h.ClientID)
+	if h.Account != "" {
+		set("iap", "account", h.Account)
+	}
+
+	// let users manipulate standard 'https://' urls
+	insteadOf := &git.GitConfig{
+		Url:     helperProtocol() + "://" + repo.Host,
+		Section: "url",
+		Key:     "insteadOf",
+		Value:   https,
+		Scope:   h.ConfigScope,
+	}
+	if strings.Contains(repo.Host, "*") {
+		p.Suggestions = append(p.Suggestions, insteadOf)
+	} else {
+		p.Entries = append(p.Entries, insteadOf)
+	}
+
+	// set cookie path
+	set("http", "cookieFile", cookieFilePath(scope))
+
+	return p, nil
+}
+
+// cookieFilePath returns the cookie jar of the URL a repository is configured for.
+func cookieFilePath(scope string) string {
+	domainSlug := strings.ReplaceAll(strings.TrimPrefix(scope, "https://"), ".", "-")
+	domainSlug = strings.ReplaceAll(domainSlug, "*", "_wildcard_")
+	domainSlug = strings.ReplaceAll(domainSlug, "/", "_")
+	return fmt.Sprintf("~/.config/gcp-iap/%s.cookie", domainSlug)
+}
+
+// configScope returns the URL a repository is configured for: its host, or its path with scopePath.
+func configScope(repoURL string, scopePath bool) (*_url.URL, string, error) {
+	repo, err := _url.Parse(repoURL)
+	if err != nil || repo.Host == "" {
+		return nil, "", fmt.Errorf("Could not convert %s in https://: %v", repoURL, err)
+	}
+
+	// IAP config applies to the whole host, unless paths of the host are served by different IAP backends
+	scope := fmt.Sprintf("https://%s", repo.Host)
+	if scopePath {
+		scope += strings.TrimSuffix(repo.Path, "/")
+	}
+	return repo, scope, nil
+}
+
+// print shows the git config entries of a configPlan, as the commands that would write them.
+func (p *configPlan) print(w io.Writer) {
+	fmt.Fprintf(w, "# %s\n", p.Scope)
+	if include := p.host.ConfigScope.Include(); include != nil {
+		fmt.Fprintf(w, "  git config --global --add %s %s\n", include.Name(), include.Value)
+	}
+	for _, c := range p.Entries {
+		if c.Key == "helperSecret" && !iap.IsHelperSecretRef(c.Value) {
+			masked := *c
+			masked.Value = "<secret>"
+			c = &masked
+		}
+		fmt.Fprintf(w, "  %s\n", c.CommandSuggest())
+	}
+	for _, c := range p.Suggestions {
+		fmt.Fprintf(w, "  # to be set manually, with * replaced by subdomain:\n  # %s\n", c.CommandSuggest())
+	}
+}
+
+// apply writes the git config entries of a configPlan, storing the helperSecret first if needed.
+// The application exits in case of error.
+func (p *configPlan) apply() {
+	log.Info().Msgf("Configure IAP for %s in the %s git config", p.Scope, p.host.ConfigScope)
+	if p.host.StoreSecret {
+		if _, err := iap.StoreHelperSecret(p.Scope, p.host.HelperID, p.host.HelperSecret); err != nil {
+			log.Fatal().Msgf("Could not store helperSecret for %s: %s", p.Scope, err)
+		}
+	}
+	for _, c := range p.Entries {
+		git.SetConfig(c)
+	}
+
+	if len(p.Suggestions) > 0 {
+		log.Warn().Msg("While config is valid for wildcard hosts, transparent support for https:// remotes require \"insteadOf\" config")
+		log.Info().Msg("Actual hosts must be manually configured as follows (with * replaced by subdomain):")
+		for _, c := range p.Suggestions {
+			log.Info().Msg(c.CommandSuggest())
+		}
+	}
+}
+
+// parseGitScope parses --scope. Profiles of includeIf scopes are written under ProfilesPath,
+// in a file named after their directory.
+// The application exits in case of error.
+func parseGitScope() git.ConfigScope {
+	scope, err := git.ParseConfigScope(gitScope)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	if scope.Kind == git.ScopeIncludeIf {
+		slug := strings.Trim(strings.TrimPrefix(scope.GitDir, "~"), "/")
+		slug = strings.ReplaceAll(strings.ReplaceAll(slug, ".", "-"), "/", "_")
+		scope.File = iap.ExpandHome(fmt.Sprintf("%s/%s.gitconfig", ProfilesPath, slug))
+	}
+	return scope
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	_url "net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	doctorPass = "ok"
+	doctorWarn = "warn"
+	doctorFail = "FAIL"
+	doctorSkip = "skip"
+)
+
+// A finding is the outcome of one of the checks made by 'doctor', with a hint to fix it.
+type finding struct {
+	Status  string
+	Message string
+	Hint    string
+}
+
+// A diagnosis walks through every layer involved in reaching a URL protected by IAP, recording a finding for each.
+type diagnosis struct {
+	URL      string
+	Findings []*finding
+
+	// config, account and store of the URL, read once by checkConfig
+	config  map[string]string
+	account string
+	store   iap.TokenStore
+}
+
+func (d *diagnosis) add(status, hint, format string, args ...interface{}) {
+	d.Findings = append(d.Findings, &finding{Status: status, Message: fmt.Sprintf(format, args...), Hint: hint})
+}
+
+// Failed reports whether one of the checks failed.
+func (d *diagnosis) Failed() bool {
+	for _, f := range d.Findings {
+		if f.Status == doctorFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *diagnosis) print(w io.Writer) {
+	fmt.Fprintf(w, "Diagnosing %s\n", d.URL)
+	for _, f := range d.Findings {
+		fmt.Fprintf(w, "  %-4s  %s\n", f.Status, f.Message)
+		if f.Hint != "" && f.Status != doctorPass {
+			fmt.Fprintf(w, "        hint: %s\n", f.Hint)
+		}
+	}
+}
+
+func doctor(cmd *cobra.Command, args []string) {
+	https, err := toHTTPSURL(args[0])
+	if err != nil {
+		log.Fatal().Msgf("Could not parse %s: %s", args[0], err)
+	}
+
+	d := &diagnosis{URL: https}
+	d.checkGit()
+	d.checkRemote(args[0])
+	if d.checkConfig() {
+		d.checkJar()
+		refreshTokenCached := d.checkRefreshToken()
+		d.checkTokenEndpoint()
+		if cookie := d.checkToken(refreshTokenCached); cookie != nil {
+			d.checkRequest(cookie)
+		}
+	}
+
+	d.print(os.Stdout)
+	if d.Failed() {
+		os.Exit(1)
+	}
+}
+
+// checkGit checks the version of git, and that it allows the protocol of the helper.
+func (d *diagnosis) checkGit() {
+	version, err := git.Version()
+	switch {
+	case err != nil:
+		d.add(doctorFail, "install git, and make sure it is in your $PATH", "%s", err)
+	case !git.VersionAtLeast(version, 2, 31):
+		d.add(doctorWarn, "upgrade git to 2.31 or later", "git version %s, 'exec' needs git >= 2.31", version)
+	default:
+		d.add(doctorPass, "", "git version %s", version)
+	}
+
+	if err != nil {
+		return
+	}
+
+	name := fmt.Sprintf("protocol.%s.allow", helperProtocol())
+	switch allow, _ := git.ConfigLookup(name); allow {
+	case "always":
+		d.add(doctorPass, "", "%s is %s", name, allow)
+	case "":
+		d.add(doctorWarn, fmt.Sprintf("run '%s install'", binaryName), "%s is not set, submodules using %s:// will be refused", name, helperProtocol())
+	default:
+		d.add(doctorFail, fmt.Sprintf("run '%s install'", binaryName), "%s is %s", name, allow)
+	}
+}
+
+// checkRemote checks that git hands the URL to the helper, either through an insteadOf mapping or its credential helper.
+func (d *diagnosis) checkRemote(remote string) {
+	rewritten, err := git.RewriteURL(remote)
+	switch {
+	case err != nil:
+		d.add(doctorFail, "", "%s", err)
+	case strings.HasPrefix(rewritten, helperProtocol()+"://"):
+		if rewritten == remote {
+			d.add(doctorPass, "", "%s is handled by the helper", remote)
+		} else {
+			d.add(doctorPass, "", "%s is rewritten to %s", remote, rewritten)
+		}
+	default:
+		if helper, _, _ := git.ConfigURLMatch("credential.helper", d.URL); strings.Contains(helper, "credential") {
+			d.add(doctorPass, "", "%s is authenticated by the credential helper '%s'", remote, helper)
+			return
+		}
+		d.add(doctorWarn, fmt.Sprintf("use %s:// URLs, or set url.%s://<host>.insteadOf for this host", helperProtocol(), helperProtocol()),
+			"%s is not rewritten to %s://, git will not use the helper", remote, helperProtocol())
+	}
+}
+
+// checkConfig checks the IAP config of the URL and opens its token store, and reports whether the following checks can run.
+func (d *diagnosis) checkConfig() bool {
+	if err := iap.CheckConfig(d.URL); err != nil {
+		d.add(doctorFail, fmt.Sprintf("run '%s configure --repoURL %s'", binaryName, d.URL), "%s", err)
+		return false
+	}
+	d.config = map[string]string{}
+	for _, key := range iap.RequiredConfig {
+		value, origin, _, err := git.ConfigOriginURLMatch(key, d.URL)
+		if err != nil {
+			d.add(doctorFail, "", "%s", err)
+			return false
+		}
+		d.config[key] = value
+		if key == "iap.helperSecret" && !iap.IsHelperSecretRef(value) {
+			value = "<secret>"
+		}
+		d.add(doctorPass, "", "%s is %s, from %s", key, value, origin)
+	}
+
+	account, err := iap.LookupAccount(d.URL)
+	if err != nil {
+		d.add(doctorFail, "", "%s", err)
+		return false
+	}
+	d.account = account
+
+	// the store is opened once, it may prompt for its passphrase
+	if d.store, err = iap.NewTokenStore(d.URL); err != nil {
+		d.add(doctorFail, "check iap.tokenStore", "%s", err)
+		return false
+	}
+	if _, err := iap.ResolveHelperSecret(d.store, d.URL, d.config["iap.helperSecret"]); err != nil {
+		d.add(doctorFail, fmt.Sprintf("run '%s configure' again with --helperSecret", binaryName), "%s", err)
+		return false
+	}
+	return true
+}
+
+// checkJar checks that the cookie jar of the URL can only be read by its owner.
+func (d *diagnosis) checkJar() {
+	if _, ok := d.store.(iap.ExpiringTokenStore); ok {
+		d.add(doctorPass, "", "IAP auth tokens are kept in the token store, not in a cookie jar")
+		return
+	}
+
+	jar := iap.ExpandHome(d.config["http.cookieFile"])
+	info, err := os.Stat(jar)
+	switch {
+	case os.IsNotExist(err):
+		d.add(doctorWarn, fmt.Sprintf("run '%s check origin %s'", binaryName, d.URL), "cookie jar %s does not exist yet", jar)
+	case err != nil:
+		d.add(doctorFail, "", "cookie jar %s: %s", jar, err)
+	case info.Mode().Perm()&0o077 != 0:
+		d.add(doctorFail, fmt.Sprintf("run 'chmod 600 %s'", jar), "cookie jar %s can be read by other users (%s)", jar, info.Mode().Perm())
+	default:
+		d.add(doctorPass, "", "cookie jar %s (%s)", jar, info.Mode().Perm())
+	}
+}
+
+// checkRefreshToken checks that a refresh token is cached, and reports whether it is.
+func (d *diagnosis) checkRefreshToken() bool {
+	helperID := d.config["iap.helperID"]
+	s := iap.Status(d.URL, d.config["iap.clientID"], helperID, d.account, d.config["http.cookieFile"], true)
+	if !s.RefreshTokenCached {
+		d.add(doctorWarn, fmt.Sprintf("run '%s check origin %s' to login", binaryName, d.URL),
+			"no refresh token cached for helperID=%s,account=%s, the next refresh needs a browser login", helperID, d.account)
+		return false
+	}
+	d.add(doctorPass, "", "refresh token cached for helperID=%s,account=%s", helperID, d.account)
+	return true
+}
+
+// checkTokenEndpoint checks that Google's token endpoint can be reached, through the proxy git would use.
+func (d *diagnosis) checkTokenEndpoint() {
+	endpoint := google.Endpoint.TokenURL
+	transport, via, err := gitTransport(endpoint)
+	if err != nil {
+		d.add(doctorFail, "check http.sslCAInfo", "%s", err)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+
+	resp, err := client.PostForm(endpoint, _url.Values{})
+	if err != nil {
+		d.add(doctorFail, "check http.proxy, or the HTTPS_PROXY environment variable", "could not reach %s (proxy: %s): %s", endpoint, via, err)
+		return
+	}
+	resp.Body.Close()
+	d.add(doctorPass, "", "%s is reachable (proxy: %s)", endpoint, via)
+}
+
+// checkToken checks the IAP auth token of the URL, refreshing it when possible without opening the browser.
+// Like iap.Status, iap.ReadCookie and iap.RefreshCookie get the store opened by checkConfig, as stores are kept per process.
+func (d *diagnosis) checkToken(refreshTokenCached bool) *iap.Cookie {
+	clientID := d.config["iap.clientID"]
+	cookie, err := iap.ReadCookie(d.URL)
+	var audienceErr *iap.AudienceError
+	switch {
+	case errors.As(err, &audienceErr):
+		// e.g. a jar left over from a previous iap.clientID, IAP would refuse it
+		err = fmt.Errorf("cached for audience %s, not %s", audienceErr.Audience, audienceErr.ClientID)
+		d.add(doctorWarn, "", "IAP auth token in %s is %s", audienceErr.CookieFile, err)
+	case err != nil:
+	case cookie.Expired():
+		err = fmt.Errorf("expired at %s", time.Unix(cookie.Claims.ExpiresAt, 0).Format(time.RFC3339))
+	default:
+		d.add(doctorPass, "", "IAP auth token for audience %s, valid until %s", cookie.Claims.Audience, time.Unix(cookie.Claims.ExpiresAt, 0).Format(time.RFC3339))
+		return cookie
+	}
+
+	if !refreshTokenCached {
+		d.add(doctorSkip, fmt.Sprintf("run '%s check origin %s' to login", binaryName, d.URL), "no usable IAP auth token (%s), and getting one needs a browser login", err)
+		return nil
+	}
+	if cookie, err = iap.RefreshCookie(d.URL); err != nil {
+		d.add(doctorFail, fmt.Sprintf("run '%s check --forcebrowser origin %s' to login again", binaryName, d.URL), "could not refresh the IAP auth token: %s", err)
+		return nil
+	}
+	if cookie.Claims.Audience != clientID {
+		d.add(doctorFail, "check iap.clientID", "IAP auth token is for audience %s, not %s", cookie.Claims.Audience, clientID)
+		return nil
+	}
+	d.add(doctorPass, "", "IAP auth token refreshed for audience %s, valid until %s", cookie.Claims.Audience, time.Unix(cookie.Claims.ExpiresAt, 0).Format(time.RFC3339))
+	return cookie
+}
+
+// checkRequest makes an authenticated request to the URL, and explains the answer of IAP.
+func (d *diagnosis) checkRequest(cookie *iap.Cookie) {
+	target := strings.TrimSuffix(d.URL, "/") + "/info/refs?service=git-upload-pack"
+	transport, _, err := gitTransport(d.URL)
+	if err != nil {
+		d.add(doctorFail, "check http.sslCAInfo", "%s", err)
+		return
+	}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		d.add(doctorFail, "", "%s", err)
+		return
+	}
+	req.Header.Set("Proxy-Authorization", fmt.Sprintf("Bearer %s", cookie.Token.Raw))
+	resp, err := client.Do(req)
+	if err != nil {
+		d.add(doctorFail, "check your network, http.proxy and http.sslCAInfo", "could not reach %s: %s", d.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get(iapauth.GeneratedResponseHeader) == "" {
+		if loc, err := resp.Location(); err == nil && loc.Host == iap.GoogleSignInHost {
+			d.add(doctorFail, "check that iap.clientID is the OAuth Client ID of the IAP instance", "IAP refused the token, redirecting to %s", loc.Host)
+			return
+		}
+		d.add(doctorPass, "", "IAP let the request through, the backend answered HTTP %d", resp.StatusCode)
+		return
+	}
+
+	message := iapErrorMessage(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		d.add(doctorFail, "check that iap.clientID is the OAuth Client ID of the IAP instance", "IAP refused the token (HTTP 401): %s", message)
+	case http.StatusForbidden:
+		d.add(doctorFail, "ask for the 'IAP-secured Web App User' role on this resource, or check iap.account",
+			"IAP denied access (HTTP 403): %s", message)
+	default:
+		d.add(doctorFail, "", "IAP answered HTTP %d: %s", resp.StatusCode, message)
+	}
+}
+
+var (
+	htmlTags   = regexp.MustCompile(`(?s)<(script|style).*?</(script|style)>|<[^>]*>`)
+	whitespace = regexp.MustCompile(`\s+`)
+)
+
+// iapErrorMessage extracts the text of an error page of IAP.
+func iapErrorMessage(body io.Reader) string {
+	data, _ := ioutil.ReadAll(io.LimitReader(body, 64*1024))
+	text := strings.TrimSpace(whitespace.ReplaceAllString(htmlTags.ReplaceAllString(string(data), " "), " "))
+	if len(text) > 300 {
+		text = text[:300] + "..."
+	}
+	if text == "" {
+		return "no details"
+	}
+	return text
+}
+
+// gitTransport returns a transport going through the proxy git would use for a URL, and trusting the
+// certificate authorities of its http.sslCAInfo, along with a description of the proxy.
+func gitTransport(target string) (*http.Transport, string, error) {
+	proxy, via := gitProxy(target)
+	transport := &http.Transport{Proxy: proxy}
+
+	caInfo, ok, err := git.ConfigURLMatch("http.sslCAInfo", target)
+	if err != nil {
+		return nil, "", err
+	}
+	if ok && caInfo != "" {
+		pem, err := ioutil.ReadFile(iap.ExpandHome(caInfo))
+		if err != nil {
+			return nil, "", fmt.Errorf("could not read http.sslCAInfo of %s: %s", target, err)
+		}
+		// like curl, git trusts the bundle instead of the system's certificate authorities
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, "", fmt.Errorf("http.sslCAInfo of %s: no certificate found in %s", target, caInfo)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return transport, via, nil
+}
+
+// gitProxy returns the proxy git would use for a URL, from http.proxy or the environment, and a description of it
+// without its password.
+func gitProxy(target string) (func(*http.Request) (*_url.URL, error), string) {
+	if proxy, ok, _ := git.ConfigURLMatch("http.proxy", target); ok && proxy != "" {
+		if !strings.Contains(proxy, "://") {
+			proxy = "http://" + proxy
+		}
+		if u, err := _url.Parse(proxy); err == nil {
+			return http.ProxyURL(u), u.Redacted()
+		}
+	}
+	return http.ProxyFromEnvironment, "from environment"
+}
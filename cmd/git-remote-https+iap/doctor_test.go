@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitTransport(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	get := func() error {
+		transport, _, err := gitTransport(srv.URL)
+		if err != nil {
+			return err
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get(); err == nil {
+		t.Fatal("the certificate of the server should not be trusted without http.sslCAInfo")
+	}
+
+	bundle := filepath.Join(home, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(bundle, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("git", "config", "--global", "http."+srv.URL+".sslCAInfo", bundle).CombinedOutput(); err != nil {
+		t.Fatalf("git config: %s\n%s", err, out)
+	}
+	if err := get(); err != nil {
+		t.Errorf("the certificate of http.sslCAInfo is not trusted: %s", err)
+	}
+}
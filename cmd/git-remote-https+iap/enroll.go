@@ -0,0 +1,55 @@
+package main
+
+import (
+	_url "net/url"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/rs/zerolog/log"
+)
+
+// autoEnroll records the insteadOf mapping and the cookie jar of a host configured through a wildcard host,
+// when 'iap.autoEnroll' is set, so that its https:// URLs use the helper from the next command on.
+// They are written to the git config file holding the wildcard config. Failures are only logged.
+func autoEnroll(url string) {
+	if !git.ConfigGetURLMatchBool("iap.autoEnroll", url) {
+		return
+	}
+	https, err := toHTTPSURL(url)
+	if err != nil {
+		return
+	}
+	u, err := _url.Parse(https)
+	if err != nil {
+		return
+	}
+	host, base := u.Host, "https://"+u.Host
+
+	if rewritten, err := git.RewriteURL(base + "/"); err == nil && strings.HasPrefix(rewritten, helperProtocol()+"://") {
+		log.Debug().Msgf("[autoEnroll] %s is already enrolled", host)
+		return
+	}
+	// hosts configured with 'configure' have their own mapping, which may have been removed on purpose
+	for _, c := range git.ConfigGetRegexp(`^iap\..*\.clientid$`) {
+		if h, err := urlHost(c.Url); err == nil && h == host {
+			return
+		}
+	}
+
+	_, origin, ok, err := git.ConfigOriginURLMatch("iap.clientID", https)
+	if err != nil || !ok || origin.File == "" {
+		log.Debug().Msgf("[autoEnroll] Could not find the git config file of %s", host)
+		return
+	}
+	scope := git.ConfigScope{Kind: git.ScopeFile, File: origin.File}
+	for _, c := range []*git.GitConfig{
+		{Url: helperProtocol() + "://" + host, Section: "url", Key: "insteadOf", Value: base, Scope: scope},
+		{Url: base, Section: "http", Key: "cookieFile", Value: cookieFilePath(base), Scope: scope},
+	} {
+		if err := git.WriteConfig(c); err != nil {
+			log.Warn().Msgf("[autoEnroll] Could not enroll %s: %s", host, err)
+			return
+		}
+	}
+	log.Info().Msgf("[autoEnroll] %s enrolled in %s, its https:// URLs now use %s", host, origin, binaryName)
+}
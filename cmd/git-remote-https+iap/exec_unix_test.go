@@ -0,0 +1,75 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+)
+
+func TestRunWithCookieJarInterrupt(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "child")
+	cookie := &iap.Cookie{Domain: "git.example.com"}
+	cookie.Token.Raw = "token"
+	cookie.Claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+
+	// the child reports its pid and cookie jar, then waits for an interrupt with the default disposition
+	script := `echo "$$ $GIT_IAP_COOKIE_FILE" > "$0.tmp" && mv "$0.tmp" "$0" && exec sleep 30`
+
+	type result struct {
+		code int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		code, err := runWithCookieJar("https://git.example.com", cookie, []string{"sh", "-c", script, out})
+		done <- result{code, err}
+	}()
+
+	var fields []string
+	for deadline := time.Now().Add(10 * time.Second); len(fields) != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the child did not start")
+		}
+		data, _ := ioutil.ReadFile(out)
+		fields = strings.Fields(string(data))
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar := fields[1]
+
+	// Ctrl-C interrupts the whole process group: the parent as well as the child
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(pid, syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if r.code == 0 {
+			t.Error("the interrupted child exited with code 0")
+		}
+	case <-time.After(10 * time.Second):
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Fatal("the child ignored SIGINT")
+	}
+	if _, err := os.Stat(jar); !os.IsNotExist(err) {
+		t.Errorf("the cookie jar %s was not removed: %v", jar, err)
+	}
+}
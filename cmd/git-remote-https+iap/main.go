@@ -1,21 +1,46 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	_url "net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/agent"
 	"github.com/adohkan/git-remote-https-iap/internal/git"
 	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	ilog "github.com/adohkan/git-remote-https-iap/internal/log"
+	"github.com/adohkan/git-remote-https-iap/internal/proxy"
+	gitremote "github.com/adohkan/git-remote-https-iap/internal/remote"
+	jwt "github.com/golang-jwt/jwt"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
 const (
+	// CAPath and CAKeyPath locate the CA used by the forward proxy to terminate TLS for IAP hosts
+	CAPath    = "~/.config/gcp-iap/ca.pem"
+	CAKeyPath = "~/.config/gcp-iap/ca-key.pem"
+
+	// AgentSockPath is the default location of the agent's socket
+	AgentSockPath = "~/.config/gcp-iap/agent.sock"
+
+	// ProfilesPath is where 'configure --scope includeIf:<gitdir>' writes the profile of a directory
+	ProfilesPath = "~/.config/gcp-iap/profiles"
+
+	// TokenEnvVariable and CookieFileEnvVariable expose the IAP auth token to commands run with 'exec'
+	TokenEnvVariable      = "GIT_IAP_TOKEN"
+	CookieFileEnvVariable = "GIT_IAP_COOKIE_FILE"
+
 	// DebugEnvVariable is the name of the environment variable that needs to be set in order to enable debug logging
 	DebugEnvVariable = "GIT_IAP_VERBOSE"
 )
@@ -25,10 +50,40 @@ var (
 	version    string
 
 	// only used in configureCmd
-	repoURL, helperID, helperSecret, clientID string
+	repoURL, helperID, helperSecret, clientID, account, discoverURL string
+	storeSecret, scopePath                                          bool
 
 	// Only used in checkcmd
-	forcebrowser bool
+	forcebrowser  bool
+	checkRepoPath string
+
+	// Only used in proxyCmd and forwardProxyCmd
+	listenAddr  string
+	allowRemote bool
+
+	// Only used in agentCmd
+	agentSock string
+
+	// Only used in tokenCmd
+	tokenFormat string
+
+	// Only used in tokenCmd and execCmd
+	minValidity time.Duration
+
+	// Only used in execCmd
+	execURL string
+
+	// Only used in configureCmd, installProtocolCmd, unconfigureCmd, uninstallCmd and forwardProxyCmd
+	gitScope string
+
+	// Only used in unconfigureCmd, uninstallCmd and adoptCmd
+	dryRun bool
+
+	// Only used in adoptCmd
+	adoptReverse bool
+
+	// Only used in statusCmd
+	statusJSON, statusShort bool
 
 	rootCmd = &cobra.Command{
 		Use:   fmt.Sprintf("%s remote url", binaryName),
@@ -49,16 +104,103 @@ var (
 		Run:   installGitProtocol,
 	}
 
+	uninstallCmd = &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove the protocol and every IAP configuration from Git config, along with their cookie jars and tokens",
+		Run:   uninstallIAP,
+	}
+
 	configureCmd = &cobra.Command{
 		Use:   "configure",
 		Short: "Configure IAP for a given repository",
 		Run:   configureIAP,
 	}
 
+	statusCmd = &cobra.Command{
+		Use:   "status [url...]",
+		Short: "List the URLs configured for IAP and the health of their tokens",
+		Run:   status,
+	}
+
+	doctorCmd = &cobra.Command{
+		Use:   "doctor url",
+		Short: "Diagnose why git cannot reach an IAP protected url",
+		Args:  cobra.ExactArgs(1),
+		Run:   doctor,
+	}
+
+	adoptCmd = &cobra.Command{
+		Use:   "adopt [path]",
+		Short: "Rewrite the https:// URLs of a repository and its submodules that are configured for IAP to https+iap://",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   adopt,
+	}
+
+	unconfigureCmd = &cobra.Command{
+		Use:   "unconfigure",
+		Short: "Remove the IAP configuration of a given repository, along with its cookie jar and tokens",
+		Run:   unconfigureIAP,
+	}
+
+	migrateSecretsCmd = &cobra.Command{
+		Use:   "migrate-secrets",
+		Short: "Move plaintext iap.helperSecret values out of the global Git config",
+		Run:   migrateSecrets,
+	}
+
+	proxyCmd = &cobra.Command{
+		Use:   "proxy url",
+		Short: "Serve an IAP protected host on localhost, injecting a fresh token in every request",
+		Args:  cobra.ExactArgs(1),
+		Run:   runProxy,
+	}
+
+	forwardProxyCmd = &cobra.Command{
+		Use:   "forward-proxy",
+		Short: "Run an HTTP proxy adding IAP auth to requests for configured hosts, usable as git's http.proxy",
+		Args:  cobra.NoArgs,
+		Run:   runForwardProxy,
+	}
+
+	agentCmd = &cobra.Command{
+		Use:   "agent",
+		Short: "Hold IAP auth tokens in memory and serve them over a Unix socket, like ssh-agent",
+		Args:  cobra.NoArgs,
+		Run:   runAgent,
+	}
+
+	credentialCmd = &cobra.Command{
+		Use:       "credential get|store|erase",
+		Short:     "Act as a git credential helper, supplying the IAP auth token as a Bearer credential",
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"get", "store", "erase"},
+		Run:       credential,
+	}
+
+	tokenCmd = &cobra.Command{
+		Use:   "token url",
+		Short: "Refresh token for url if needed, then print it",
+		Args:  cobra.ExactArgs(1),
+		Run:   printToken,
+	}
+
+	execCmd = &cobra.Command{
+		Use:   "exec --url url -- command [args...]",
+		Short: "Run a command with IAP auth for url injected in its environment",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   execWithIAP,
+	}
+
 	checkCmd = &cobra.Command{
-		Use:   "check remote url",
-		Short: "Refresh token for remote url if needed, then exit",
-		Run:   check,
+		Use:   "check [remote url]",
+		Short: "Refresh token for remote url, or for a whole repository with --repo, if needed, then exit",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if checkRepoPath != "" {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.ExactArgs(2)(cmd, args)
+		},
+		Run: check,
 	}
 )
 
@@ -66,21 +208,70 @@ func init() {
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(installProtocolCmd)
 	rootCmd.AddCommand(checkCmd)
+	rootCmd.AddCommand(proxyCmd)
+	rootCmd.AddCommand(forwardProxyCmd)
+	rootCmd.AddCommand(agentCmd)
+	rootCmd.AddCommand(credentialCmd)
+	rootCmd.AddCommand(tokenCmd)
+	rootCmd.AddCommand(execCmd)
 
 	configureCmd.Flags().StringVar(&repoURL, "repoURL", "", "URL of the git repository to configure (required)")
-	configureCmd.MarkFlagRequired("repoURL")
 	configureCmd.Flags().StringVar(&helperID, "helperID", "", "OAuth Client ID for the helper (required)")
-	configureCmd.MarkFlagRequired("helperID")
 	configureCmd.Flags().StringVar(&helperSecret, "helperSecret", "", "OAuth Client Secret for the helper (required)")
-	configureCmd.MarkFlagRequired("helperSecret")
-	configureCmd.Flags().StringVar(&clientID, "clientID", "", "OAuth Client ID of the IAP instance (required)")
-	configureCmd.MarkFlagRequired("clientID")
+	configureCmd.Flags().StringVar(&clientID, "clientID", "", "OAuth Client ID of the IAP instance (discovered from --repoURL if omitted)")
+	configureCmd.Flags().StringVar(&account, "account", "", "Name of the account used to cache tokens, for users with several Google accounts")
+	configureCmd.Flags().BoolVar(&scopePath, "scopePath", false, "Configure IAP for the path of --repoURL only, instead of its whole host")
+	configureCmd.Flags().BoolVar(&storeSecret, "storeSecret", false, "Store the helper's OAuth Client Secret in the token store instead of the Git config")
+	configureCmd.Flags().StringVar(&discoverURL, "discover", "", "Configure every host listed in the document of your organisation, at an https:// URL or in a file, instead of --repoURL")
+
+	for _, cmd := range []*cobra.Command{configureCmd, installProtocolCmd} {
+		cmd.Flags().StringVar(&gitScope, "scope", git.ScopeGlobal, "Git config to write to: global, system, local, file:<path> or includeIf:<gitdir>")
+	}
+
+	adoptCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show the changes as a diff without making them")
+	adoptCmd.Flags().BoolVar(&adoptReverse, "reverse", false, "Rewrite https+iap:// URLs back to https://")
+
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the status as JSON")
+	statusCmd.Flags().BoolVar(&statusShort, "short", false, "Print the status on one line, for shell prompts")
+
+	unconfigureCmd.Flags().StringVar(&repoURL, "repoURL", "", "URL of the git repository to unconfigure, as given to configure (required)")
+	unconfigureCmd.MarkFlagRequired("repoURL")
+	unconfigureCmd.Flags().BoolVar(&scopePath, "scopePath", false, "Unconfigure the path of --repoURL, if it was configured with --scopePath")
+	for _, cmd := range []*cobra.Command{unconfigureCmd, uninstallCmd} {
+		cmd.Flags().StringVar(&gitScope, "scope", git.ScopeGlobal, "Git config to remove from: global, system, local, file:<path> or includeIf:<gitdir>")
+		cmd.Flags().BoolVar(&dryRun, "dry-run", false, "List the changes without making them")
+	}
 
 	checkCmd.Flags().BoolVarP(&forcebrowser, "forcebrowser", "f", false, "Forces browser refresh flow")
+	checkCmd.Flags().StringVar(&checkRepoPath, "repo", "", "Refresh the tokens of the remotes, submodules and LFS endpoints of the repository at this path")
 
-	rootCmd.AddCommand(configureCmd)
+	proxyCmd.Flags().StringVarP(&listenAddr, "listen", "l", "127.0.0.1:8080", "Local address to listen on")
+	forwardProxyCmd.Flags().StringVarP(&listenAddr, "listen", "l", "127.0.0.1:8081", "Local address to listen on")
+	forwardProxyCmd.Flags().StringVar(&gitScope, "scope", git.ScopeGlobal, "Git config the printed commands write to: global, system, local, file:<path> or includeIf:<gitdir>")
+	for _, cmd := range []*cobra.Command{proxyCmd, forwardProxyCmd} {
+		cmd.Flags().BoolVar(&allowRemote, "allow-remote", false, "Allow listening on an address other hosts can reach, which authenticates them as you")
+	}
+	agentCmd.Flags().StringVarP(&agentSock, "socket", "s", AgentSockPath, "Path of the Unix socket to listen on")
 
-	// set log level
+	tokenCmd.Flags().StringVarP(&tokenFormat, "format", "o", "raw", "Output format: raw, proxy-authorization, authorization, cookie or json")
+	tokenCmd.Flags().DurationVar(&minValidity, "min-validity", 0, "Refresh the token if it expires within this duration")
+
+	execCmd.Flags().StringVar(&execURL, "url", "", "URL of the IAP protected host (required)")
+	execCmd.MarkFlagRequired("url")
+	execCmd.Flags().DurationVar(&minValidity, "min-validity", 0, "Refresh the token if it expires within this duration")
+	// flags after the command belong to the command
+	execCmd.Flags().SetInterspersed(false)
+
+	rootCmd.AddCommand(configureCmd)
+	rootCmd.AddCommand(migrateSecretsCmd)
+	rootCmd.AddCommand(unconfigureCmd)
+	rootCmd.AddCommand(uninstallCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(adoptCmd)
+
+	// set log level, the internal packages log like the helper
+	ilog.Logger = log.Logger
 	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
 	if debug, _ := strconv.ParseBool(os.Getenv(DebugEnvVariable)); debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
@@ -99,101 +290,435 @@ func execute(cmd *cobra.Command, args []string) {
 	log.Debug().Msgf("%s %s %s", binaryName, remote, url)
 
 	c := handleIAPAuthCookieFor(url, false)
+	autoEnroll(url)
+
+	// long-running operations may outlive the token, in which case requests go through
+	// a local forwarder that refreshes it
+	if git.ConfigGetURLMatchBool("iap.nativeHelper", url) {
+		nativeRemoteHelper(remote, url, c)
+		return
+	}
+	if git.ConfigGetURLMatchBool("iap.refreshAhead", url) {
+		forwardRemoteHTTPSHelper(remote, url, c)
+		return
+	}
 	git.PassThruRemoteHTTPSHelper(remote, url, c.Token.Raw)
 }
 
+func nativeRemoteHelper(remote, url string, c *iap.Cookie) {
+	https, err := toHTTPSURL(url)
+	if err != nil {
+		log.Fatal().Msgf("[nativeRemoteHelper] Could not convert %s in https://: %s", url, err)
+	}
+	target, _ := _url.Parse(https)
+
+	// IAP redirects are detected by the helper
+	client := iapauth.NewClient(proxy.NewTokenSource(https, c))
+	h := gitremote.NewHelper(remote, target, client)
+	err = h.Run()
+	h.Close()
+	if err != nil {
+		log.Fatal().Msgf("%s", err)
+	}
+}
+
+func forwardRemoteHTTPSHelper(remote, url string, c *iap.Cookie) {
+	https, err := toHTTPSURL(url)
+	if err != nil {
+		log.Fatal().Msgf("[forwardRemoteHTTPSHelper] Could not convert %s in https://: %s", url, err)
+	}
+	target, _ := _url.Parse(https)
+	target.Path = ""
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal().Msgf("[forwardRemoteHTTPSHelper] Could not listen: %s", err)
+	}
+	defer l.Close()
+
+	f := proxy.NewForwarder(target, proxy.NewTokenSource(https, c))
+	go f.Serve(l)
+
+	git.ForwardRemoteHTTPSHelper(remote, url, l.Addr().String())
+}
+
 func check(cmd *cobra.Command, args []string) {
+	if checkRepoPath != "" {
+		log.Debug().Msgf("%s check --repo %s: forcebrowser=%s", binaryName, checkRepoPath, strconv.FormatBool(forcebrowser))
+		checkRepo(checkRepoPath)
+		return
+	}
+
 	remote, url := args[0], args[1]
 	log.Debug().Msgf("%s check %s %s: forcebrowser=%s", binaryName, remote, url, strconv.FormatBool(forcebrowser))
 
 	handleIAPAuthCookieFor(url, forcebrowser)
 }
 
-func printVersion(cmd *cobra.Command, args []string) {
-	fmt.Printf("%s %s\n", binaryName, version)
+func runProxy(cmd *cobra.Command, args []string) {
+	url := args[0]
+	https, err := toHTTPSURL(url)
+	if err != nil {
+		log.Fatal().Msgf("[runProxy] Could not convert %s in https://: %s", url, err)
+	}
+	target, _ := _url.Parse(https)
+	target.Path = ""
+
+	c := handleIAPAuthCookieFor(https, false)
+	tokens := proxy.NewTokenSource(https, c)
+	go tokens.KeepFresh(make(chan struct{}))
+
+	l, err := listen(listenAddr)
+	if err != nil {
+		log.Fatal().Msgf("[runProxy] Could not listen on %s: %s", listenAddr, err)
+	}
+
+	fmt.Printf("Forwarding http://%s to %s\n", l.Addr(), target)
+	if err := proxy.NewForwarder(target, tokens).Serve(l); err != nil {
+		log.Fatal().Msgf("[runProxy] %s", err)
+	}
 }
 
-func installGitProtocol(cmd *cobra.Command, args []string) {
-	p := strings.TrimLeft(binaryName, "git-remote-")
-	git.InstallProtocol(p)
-	log.Info().Msgf("%s protocol configured in git!", p)
+// listen listens on a loopback address, or on any address with --allow-remote:
+// requests reaching the proxies are authenticated as the user.
+func listen(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); !allowRemote && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%s can be reached from other hosts, which would be authenticated as you: listen on 127.0.0.1, or use --allow-remote", addr)
+	}
+	return net.Listen("tcp", addr)
 }
 
-func configureIAP(cmd *cobra.Command, args []string) {
-	repo, err := _url.Parse(repoURL)
-	https := fmt.Sprintf("https://%s", repo.Host)
+func runForwardProxy(cmd *cobra.Command, args []string) {
+	scope := parseGitScope()
+	ca, err := proxy.LoadOrCreateCA(iap.ExpandHome(CAPath), iap.ExpandHome(CAKeyPath))
 	if err != nil {
-		log.Error().Msgf("Could not convert %s in https://: %s", https, err)
+		log.Fatal().Msgf("[runForwardProxy] %s", err)
 	}
 
-	log.Info().Msgf("Configure IAP for %s", https)
-	git.SetGlobalConfig(https, "iap", "helperID", helperID)
-	git.SetGlobalConfig(https, "iap", "helperSecret", helperSecret)
-	git.SetGlobalConfig(https, "iap", "clientID", clientID)
+	// hosts are matched like git does, so that wildcard hosts are supported
+	var mu sync.Mutex
+	known := map[string]bool{}
+	isIAPHost := func(host string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := known[host]; ok {
+			return known[host]
+		}
+		_, known[host], _ = git.ConfigURLMatch("iap.clientID", fmt.Sprintf("https://%s", host))
+		// paths of the host may be configured on their own, with --scopePath
+		for _, c := range git.ConfigGetRegexp(`^iap\..*\.clientid$`) {
+			if known[host] {
+				break
+			}
+			if h, err := urlHost(c.Url); err == nil && matchesWildcard(h, host) {
+				known[host] = true
+			}
+		}
+		return known[host]
+	}
+
+	l, err := listen(listenAddr)
+	if err != nil {
+		log.Fatal().Msgf("[runForwardProxy] Could not listen on %s: %s", listenAddr, err)
+	}
+
+	fmt.Printf("Proxy listening on http://%s\n", l.Addr())
+	fmt.Println("Configure git to use it for IAP hosts with:")
+	var urls []string
+	for _, c := range git.ConfigGetRegexp(`^iap\..*\.clientid$`) {
+		if contains(urls, c.Url) {
+			continue
+		}
+		urls = append(urls, c.Url)
+		for _, suggest := range []*git.GitConfig{
+			{Url: c.Url, Section: "http", Key: "proxy", Value: fmt.Sprintf("http://%s", l.Addr()), Scope: scope},
+			{Url: c.Url, Section: "http", Key: "sslCAInfo", Value: CAPath, Scope: scope},
+		} {
+			fmt.Printf("  %s\n", suggest.CommandSuggest())
+		}
+	}
+
+	if err := proxy.NewForwardProxy(ca, isIAPHost).Serve(l); err != nil {
+		log.Fatal().Msgf("[runForwardProxy] %s", err)
+	}
+}
+
+func runAgent(cmd *cobra.Command, args []string) {
+	path := iap.ExpandHome(agentSock)
+	l, err := agent.Listen(path)
+	if err != nil {
+		log.Fatal().Msgf("[runAgent] Could not listen on %s: %s", path, err)
+	}
+	defer l.Close()
+
+	fmt.Printf("%s=%s; export %s;\n", agent.SockEnvVariable, path, agent.SockEnvVariable)
+	if err := agent.New().Serve(l); err != nil {
+		log.Fatal().Msgf("[runAgent] %s", err)
+	}
+}
+
+// credential implements the git credential helper protocol.
+// see: https://git-scm.com/docs/gitcredentials#_custom_helpers
+func credential(cmd *cobra.Command, args []string) {
+	c, err := git.ReadCredential(os.Stdin)
+	if err != nil {
+		log.Fatal().Msgf("[credential] %s", err)
+	}
+
+	// only answer for IAP protected URLs, other helpers can handle the rest
+	url := c.URL()
+	if c.Protocol != "https" || iap.CheckConfig(url) != nil {
+		log.Debug().Msgf("[credential] %s is not configured for IAP", url)
+		return
+	}
+
+	switch args[0] {
+	case "get":
+		if !c.HasCapability("authtype") {
+			log.Debug().Msgf("[credential] git does not support authtype, no credential for %s", url)
+			return
+		}
+		cookie := handleIAPAuthCookieFor(url, false)
+		fmt.Println("capability[]=authtype")
+		fmt.Println("authtype=Bearer")
+		fmt.Printf("credential=%s\n", cookie.Token.Raw)
+		fmt.Println("ephemeral=true")
+		fmt.Printf("password_expiry_utc=%d\n", cookie.Claims.ExpiresAt)
+	case "erase":
+		// git rejected our token: drop it, so that the next 'get' mints a new one
+		if c.AuthType == "Bearer" {
+			if err := iap.EraseCookie(url); err != nil {
+				log.Warn().Msgf("[credential] Could not erase IAP auth token for %s: %s", url, err)
+			}
+		}
+	case "store":
+		// tokens are already cached by handleIAPAuthCookieFor
+	}
+}
+
+func printToken(cmd *cobra.Command, args []string) {
+	url := args[0]
+	switch tokenFormat {
+	case "raw", "proxy-authorization", "authorization", "cookie", "json":
+	default:
+		log.Fatal().Msgf("[printToken] Unknown format '%s'", tokenFormat)
+	}
+	cookie := handleIAPAuthCookieWithin(url, minValidity)
+
+	switch tokenFormat {
+	case "raw":
+		fmt.Println(cookie.Token.Raw)
+	case "proxy-authorization":
+		fmt.Printf("Proxy-Authorization: Bearer %s\n", cookie.Token.Raw)
+	case "authorization":
+		fmt.Printf("Authorization: Bearer %s\n", cookie.Token.Raw)
+	case "cookie":
+		fmt.Println(cookie.JarLine())
+	case "json":
+		var p jwt.Parser
+		claims := jwt.MapClaims{}
+		if _, _, err := p.ParseUnverified(cookie.Token.Raw, claims); err != nil {
+			log.Fatal().Msgf("[printToken] Could not parse IAP auth token for %s: %s", url, err)
+		}
+		out, _ := json.MarshalIndent(struct {
+			Token     string        `json:"token"`
+			ExpiresAt time.Time     `json:"expires_at"`
+			Claims    jwt.MapClaims `json:"claims"`
+		}{cookie.Token.Raw, time.Unix(cookie.Claims.ExpiresAt, 0).UTC(), claims}, "", "  ")
+		fmt.Println(string(out))
+	}
+}
+
+// execWithIAP runs a command with the IAP auth token exposed in its environment:
+// as GIT_IAP_TOKEN, in a temporary cookie jar at GIT_IAP_COOKIE_FILE, and as Git config
+// entries scoped to the URL, so that git and git-lfs are authenticated without touching the global Git config.
+func execWithIAP(cmd *cobra.Command, args []string) {
+	url, err := toHTTPSURL(execURL)
+	if err != nil {
+		log.Fatal().Msgf("[execWithIAP] Could not convert %s in https://: %s", execURL, err)
+	}
+	cookie := handleIAPAuthCookieWithin(url, minValidity)
+
+	code, err := runWithCookieJar(url, cookie, args)
+	if err != nil {
+		log.Fatal().Msgf("[execWithIAP] %s", err)
+	}
+	os.Exit(code)
+}
 
-	// let users manipulate standard 'https://' urls
-	insteadOf := &git.GitConfig{
-		Url:     fmt.Sprintf("https+iap://%s", repo.Host),
-		Section: "url",
-		Key:     "insteadOf",
-		Value:   https,
+// runWithCookieJar runs a command with cookie exposed in its environment, and returns its exit code.
+// The temporary cookie jar is removed before it returns, since exiting would skip deferred calls.
+func runWithCookieJar(url string, cookie *iap.Cookie, args []string) (int, error) {
+	// interrupts reach the child through the process group: catch them rather than ignore them,
+	// since an ignored signal stays ignored across exec, and we must outlive the child to clean up the cookie jar
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+		}
+	}()
+	defer func() {
+		signal.Stop(interrupts)
+		close(interrupts)
+	}()
+
+	jar, err := ioutil.TempFile("", "gcp-iap-*.cookie")
+	if err != nil {
+		return 0, fmt.Errorf("Could not create cookie jar: %s", err)
 	}
-	if strings.Contains(repo.Host, "*") {
-		log.Warn().Msg("While config is valid for wildcard hosts, transparent support for https:// remotes require \"insteadOf\" config")
-		log.Info().Msg("Actual hosts must be manually configured as follows (with * replaced by subdomain):")
-		log.Info().Msg(insteadOf.CommandSuggestGlobal())
-	} else {
-		git.SetConfigGlobal(insteadOf)
+	defer os.Remove(jar.Name())
+	_, err = fmt.Fprintln(jar, cookie.JarLine())
+	if cerr := jar.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Could not write cookie jar: %s", err)
 	}
 
-	// set cookie path
-	domainSlug := strings.ReplaceAll(repo.Host, ".", "-")
-	domainSlug = strings.ReplaceAll(domainSlug, "*", "_wildcard_")
-	cookiePath := fmt.Sprintf("~/.config/gcp-iap/%s.cookie", domainSlug)
-	git.SetGlobalConfig(https, "http", "cookieFile", cookiePath)
+	child := exec.Command(args[0], args[1:]...)
+	child.Stdin, child.Stdout, child.Stderr = os.Stdin, os.Stdout, os.Stderr
+	child.Env = git.ConfigEnv(os.Environ(),
+		&git.GitConfig{Url: url, Section: "http", Key: "extraHeader", Value: fmt.Sprintf("Proxy-Authorization: Bearer %s", cookie.Token.Raw)},
+		&git.GitConfig{Url: url, Section: "http", Key: "cookieFile", Value: jar.Name()},
+	)
+	child.Env = append(child.Env,
+		fmt.Sprintf("%s=%s", TokenEnvVariable, cookie.Token.Raw),
+		fmt.Sprintf("%s=%s", CookieFileEnvVariable, jar.Name()),
+	)
+
+	log.Debug().Msgf("[execWithIAP] Run %s with IAP auth for %s", args, url)
+	err = child.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+func printVersion(cmd *cobra.Command, args []string) {
+	fmt.Printf("%s %s\n", binaryName, version)
+}
+
+func installGitProtocol(cmd *cobra.Command, args []string) {
+	p := helperProtocol()
+	scope := parseGitScope()
+	git.InstallProtocol(p, scope)
+	log.Info().Msgf("%s protocol configured in %s git config!", p, scope)
+}
+
+func migrateSecrets(cmd *cobra.Command, args []string) {
+	for _, c := range git.ConfigGetRegexpGlobal(`^iap\..*\.helpersecret$`) {
+		if iap.IsHelperSecretRef(c.Value) {
+			log.Debug().Msgf("[migrateSecrets] helperSecret for %s already migrated", c.Url)
+			continue
+		}
+
+		id := git.ConfigGetURLMatch("iap.helperID", c.Url)
+		ref, err := iap.StoreHelperSecret(c.Url, id, c.Value)
+		if err != nil {
+			log.Fatal().Msgf("Could not store helperSecret for %s: %s", c.Url, err)
+		}
+		git.SetGlobalConfig(c.Url, "iap", "helperSecret", ref)
+		log.Info().Msgf("helperSecret for %s moved to the token store", c.Url)
+	}
 }
 
 func handleIAPAuthCookieFor(url string, forcebrowserflow bool) *iap.Cookie {
-	// All our work will be based on the basedomain of the provided URL
-	// as IAP would be setup for the whole domain.
-	url, err := toHTTPSBaseDomain(url)
+	cookie, err := iapAuthCookieFor(url, forcebrowserflow, nil)
 	if err != nil {
-		log.Error().Msgf("[handleIAPAuthCookieFor] Could not convert %s in https://: %s", url, err)
+		log.Fatal().Msg(err.Error())
 	}
+	return cookie
+}
+
+// iapAuthCookieFor is similar to handleIAPAuthCookieFor, but returns an error instead of exiting.
+// When a refresh fails, it is retried with the browser flow, holding browser if it is not nil.
+func iapAuthCookieFor(url string, forcebrowserflow bool, browser sync.Locker) (*iap.Cookie, error) {
+	// Config is resolved against the whole URL, as IAP may be setup for the whole domain
+	// or for some paths only.
+	https, err := toHTTPSURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("[handleIAPAuthCookieFor] Could not convert %s in https://: %w", url, err)
+	}
+	url = https
 
 	log.Debug().Msgf("[handleIAPAuthCookieFor] Manage IAP auth for %s", url)
 
+	if os.Getenv(agent.SockEnvVariable) != "" && !forcebrowserflow {
+		cookie, err := cookieFromAgent(url)
+		if err == nil {
+			log.Debug().Msgf("[handleIAPAuthCookieFor] IAP Cookie from agent valid until %s", time.Unix(cookie.Claims.ExpiresAt, 0))
+			return cookie, nil
+		}
+		log.Debug().Msgf("[handleIAPAuthCookieFor] Could not get IAP Cookie from agent: %s", err)
+	}
+
+	withBrowser := func() (*iap.Cookie, error) {
+		log.Debug().Msgf("[handleIAPAuthCookieFor] Retrying with forcebrowserflow: true")
+		if browser != nil {
+			browser.Lock()
+			defer browser.Unlock()
+		}
+		return iap.NewCookie(url, true)
+	}
+
 	cookie, err := iap.ReadCookie(url)
 	switch {
 	case err != nil:
 		log.Debug().Msgf("[handleIAPAuthCookieFor] Could not read IAP cookie for %s: %s", url, err.Error())
 		cookie, err = iap.NewCookie(url, forcebrowserflow)
 		if err != nil {
-			log.Debug().Msgf("[handleIAPAuthCookieFor] Retrying with forcebrowserflow: true")
-			cookie, err = iap.NewCookie(url, true)
+			cookie, err = withBrowser()
 		}
 	case cookie.Expired():
 		log.Debug().Msgf("[handleIAPAuthCookieFor] IAP cookie for %s has expired", url)
 		cookie, err = iap.NewCookie(url, forcebrowserflow)
 		if err != nil {
-			log.Debug().Msgf("[handleIAPAuthCookieFor] Retrying with forcebrowserflow: true")
-			cookie, err = iap.NewCookie(url, true)
+			cookie, err = withBrowser()
 		}
 	case !cookie.Expired():
 		log.Debug().Msgf("[handleIAPAuthCookieFor] IAP Cookie still valid until %s", time.Unix(cookie.Claims.ExpiresAt, 0))
 	}
+	return cookie, err
+}
 
+// handleIAPAuthCookieWithin is similar to handleIAPAuthCookieFor, but also refreshes
+// the IAP auth token when it expires within d.
+func handleIAPAuthCookieWithin(url string, d time.Duration) *iap.Cookie {
+	cookie := handleIAPAuthCookieFor(url, false)
+	if d <= 0 || !cookie.ExpiresWithin(d) {
+		return cookie
+	}
+
+	log.Debug().Msgf("[handleIAPAuthCookieWithin] IAP Cookie expires within %s, refreshing", d)
+	https, _ := toHTTPSURL(url)
+	cookie, err := iap.RefreshCookie(https)
 	if err != nil {
 		log.Fatal().Msg(err.Error())
 	}
-
+	if cookie.ExpiresWithin(d) {
+		log.Fatal().Msgf("[handleIAPAuthCookieWithin] IAP auth tokens for %s are not valid for %s", url, d)
+	}
 	return cookie
 }
 
-func toHTTPSBaseDomain(addr string) (string, error) {
+func cookieFromAgent(url string) (*iap.Cookie, error) {
+	token, _, err := agent.Token(url)
+	if err != nil {
+		return nil, err
+	}
+	return iap.CookieFromToken(url, token)
+}
+
+func toHTTPSURL(addr string) (string, error) {
 	u, err := _url.Parse(addr)
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("https://%s", u.Host), nil
+	u.Scheme = "https"
+	u.User = nil
+	return u.String(), nil
 }
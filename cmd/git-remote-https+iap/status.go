@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	_url "net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func status(cmd *cobra.Command, args []string) {
+	var filters []string
+	for _, arg := range args {
+		u, err := toHTTPSURL(arg)
+		if err != nil {
+			log.Fatal().Msgf("Could not parse %s: %s", arg, err)
+		}
+		filters = append(filters, u)
+	}
+
+	statuses := []*iap.HostStatus{}
+	for _, url := range configuredURLs() {
+		if len(filters) > 0 && !matchesAny(url.Value, filters) {
+			continue
+		}
+		statuses = append(statuses, url.status())
+	}
+
+	switch {
+	case statusJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(statuses); err != nil {
+			log.Fatal().Msgf("Could not encode status: %s", err)
+		}
+	case statusShort:
+		printStatusLine(os.Stdout, statuses)
+	default:
+		for _, s := range statuses {
+			printStatus(os.Stdout, s)
+		}
+	}
+}
+
+// A configuredURL is a URL with 'iap.*' config, along with its entries keyed by their lowercase name.
+type configuredURL struct {
+	Value   string
+	Entries map[string]string
+}
+
+// configuredURLs returns every URL with 'iap.*' config visible from the current directory,
+// read at once with 'git config --get-regexp'.
+func configuredURLs() []*configuredURL {
+	var urls []*configuredURL
+	byURL := map[string]*configuredURL{}
+	cookieFiles := map[string]string{}
+
+	for _, c := range git.ConfigGetRegexp(`^(iap\..*|http\..*\.cookiefile)$`) {
+		if c.Section == "http" {
+			cookieFiles[c.Url] = c.Value
+			continue
+		}
+		u, ok := byURL[c.Url]
+		if !ok {
+			u = &configuredURL{Value: c.Url, Entries: map[string]string{}}
+			byURL[c.Url] = u
+			urls = append(urls, u)
+		}
+		// like 'git config --get', the last value wins
+		u.Entries[c.Key] = c.Value
+	}
+	for _, u := range urls {
+		if cookieFile, ok := cookieFiles[u.Value]; ok {
+			u.Entries["cookiefile"] = cookieFile
+		}
+	}
+	return urls
+}
+
+func (u *configuredURL) status() *iap.HostStatus {
+	account := u.Entries["account"]
+	if account == "" {
+		account = iap.Account(u.Value)
+	}
+	// shell prompts must never wait for a passphrase
+	return iap.Status(u.Value, u.Entries["clientid"], u.Entries["helperid"], account, u.Entries["cookiefile"], !statusShort)
+}
+
+// matchesAny reports whether a configured URL applies to one of the given URLs.
+// The host of the configured URL may be a wildcard, such as https://*.example.com.
+func matchesAny(configured string, urls []string) bool {
+	c, err := _url.Parse(configured)
+	if err != nil {
+		return false
+	}
+	for _, raw := range urls {
+		u, err := _url.Parse(raw)
+		if err != nil || u.Scheme != c.Scheme || !matchesWildcard(c.Host, u.Host) {
+			continue
+		}
+		if prefix := strings.TrimSuffix(c.Path, "/"); u.Path == c.Path || strings.HasPrefix(u.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func printStatus(w io.Writer, s *iap.HostStatus) {
+	fmt.Fprintln(w, s.URL)
+	fmt.Fprintf(w, "  clientID:       %s\n", s.ClientID)
+	fmt.Fprintf(w, "  helperID:       %s\n", s.HelperID)
+	fmt.Fprintf(w, "  account:        %s\n", s.Account)
+	if s.CookieFile != "" {
+		fmt.Fprintf(w, "  cookie jar:     %s\n", s.CookieFile)
+	}
+
+	switch {
+	case s.Expiry == nil:
+		fmt.Fprintf(w, "  IAP auth token: none\n")
+	case s.Valid():
+		fmt.Fprintf(w, "  IAP auth token: valid until %s (%s left)\n", s.Expiry.Format(time.RFC3339), time.Until(*s.Expiry).Round(time.Minute))
+	default:
+		fmt.Fprintf(w, "  IAP auth token: expired at %s\n", s.Expiry.Format(time.RFC3339))
+	}
+	if s.Expiry != nil {
+		fmt.Fprintf(w, "    email:        %s\n", s.Email)
+		fmt.Fprintf(w, "    audience:     %s\n", s.Audience)
+	}
+
+	switch {
+	case s.Locked:
+		fmt.Fprintf(w, "  refresh token:  unknown, the token store is locked\n")
+	case s.RefreshTokenCached:
+		fmt.Fprintf(w, "  refresh token:  cached, not checked with Google: if it was revoked or expired, the next refresh needs a browser login\n")
+	default:
+		fmt.Fprintf(w, "  refresh token:  none, the next refresh needs a browser login\n")
+	}
+	if s.Error != "" {
+		fmt.Fprintf(w, "  error:          %s\n", s.Error)
+	}
+}
+
+// printStatusLine prints the statuses on a single line, for shell prompts: the time left on the token
+// of each host, or why there is none.
+func printStatusLine(w io.Writer, statuses []*iap.HostStatus) {
+	var fields []string
+	for _, s := range statuses {
+		state := "expired"
+		switch {
+		case s.Error != "":
+			state = "error"
+		case s.Valid() && time.Until(*s.Expiry) >= time.Hour:
+			state = fmt.Sprintf("%dh", int(time.Until(*s.Expiry).Hours()))
+		case s.Valid():
+			state = fmt.Sprintf("%dm", int(time.Until(*s.Expiry).Minutes()))
+		case s.Locked:
+			state = "locked"
+		case s.NeedsLogin:
+			state = "login"
+		}
+		fields = append(fields, fmt.Sprintf("%s:%s", strings.TrimPrefix(s.URL, "https://"), state))
+	}
+	fmt.Fprintln(w, strings.Join(fields, " "))
+}
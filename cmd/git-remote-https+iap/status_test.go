@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+)
+
+func TestMatchesAny(t *testing.T) {
+	for _, tc := range []struct {
+		configured string
+		url        string
+		want       bool
+	}{
+		{"https://git.example.com", "https://git.example.com", true},
+		{"https://git.example.com", "https://git.example.com/group/repo.git", true},
+		{"https://git.example.com/group", "https://git.example.com/group/repo.git", true},
+		{"https://git.example.com/group/", "https://git.example.com/group/repo.git", true},
+		{"https://git.example.com/group", "https://git.example.com/groupie/repo.git", false},
+		{"https://git.example.com", "https://other.example.com", false},
+		{"https://git.example.com", "https://git.example.com:8443/repo.git", false},
+		{"https://*.example.com", "https://foo.example.com", true},
+		{"https://*.example.com", "https://foo.example.com/repo.git", true},
+		{"https://*.example.com", "https://foo.bar.example.com", false},
+		{"https://*.example.com/group", "https://foo.example.com/other/repo.git", false},
+	} {
+		if got := matchesAny(tc.configured, []string{tc.url}); got != tc.want {
+			t.Errorf("matchesAny(%s, %s) = %t, want %t", tc.configured, tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestPrintStatusLine(t *testing.T) {
+	at := func(d time.Duration) *time.Time {
+		exp := time.Now().Add(d)
+		return &exp
+	}
+
+	for _, tc := range []struct {
+		name   string
+		status iap.HostStatus
+		want   string
+	}{
+		{"hours left", iap.HostStatus{Expiry: at(2*time.Hour + time.Minute)}, "git.example.com:2h\n"},
+		{"minutes left", iap.HostStatus{Expiry: at(30*time.Minute + 30*time.Second)}, "git.example.com:30m\n"},
+		{"expired", iap.HostStatus{Expiry: at(-time.Minute), RefreshTokenCached: true}, "git.example.com:expired\n"},
+		{"needs login", iap.HostStatus{NeedsLogin: true}, "git.example.com:login\n"},
+		{"locked", iap.HostStatus{Locked: true}, "git.example.com:locked\n"},
+		{"locked with a valid token", iap.HostStatus{Expiry: at(2*time.Hour + time.Minute), Locked: true}, "git.example.com:2h\n"},
+		{"error", iap.HostStatus{Expiry: at(time.Hour), Error: "broken"}, "git.example.com:error\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.status.URL = "https://git.example.com"
+			var out bytes.Buffer
+			printStatusLine(&out, []*iap.HostStatus{&tc.status})
+			if out.String() != tc.want {
+				t.Errorf("printStatusLine = %q, want %q", out.String(), tc.want)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	printStatusLine(&out, []*iap.HostStatus{
+		{URL: "https://a.example.com", NeedsLogin: true},
+		{URL: "https://b.example.com/group", Locked: true},
+	})
+	if want := "a.example.com:login b.example.com/group:locked\n"; out.String() != want {
+		t.Errorf("printStatusLine = %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// A removal is a change made by 'unconfigure' or 'uninstall', listed before it is made.
+type removal struct {
+	Description string
+	Do          func() error
+}
+
+// A removalPlan lists the removals undoing 'configure' and 'install' in a scope of git config.
+// Tokens and secrets still used by URLs that are not being unconfigured are Kept.
+type removalPlan struct {
+	ConfigScope git.ConfigScope
+	Removals    []*removal
+	Kept        []string
+
+	// URLs being unconfigured, and descriptions of the removals already planned
+	urls map[string]bool
+	seen map[string]bool
+	// names of the config entries being unset
+	unset map[string]bool
+}
+
+func newRemovalPlan(scope git.ConfigScope, urls []string) *removalPlan {
+	p := &removalPlan{
+		ConfigScope: scope,
+		urls:        map[string]bool{},
+		seen:        map[string]bool{},
+		unset:       map[string]bool{},
+	}
+	for _, url := range urls {
+		p.urls[url] = true
+	}
+	return p
+}
+
+func unconfigureIAP(cmd *cobra.Command, args []string) {
+	_, scope, err := configScope(repoURL, scopePath)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	p := newRemovalPlan(parseGitScope(), []string{scope})
+	if !p.unconfigure(scope) {
+		log.Fatal().Msgf("IAP is not configured for %s in the %s git config", scope, p.ConfigScope)
+	}
+	p.removeProfile()
+	p.run(dryRun)
+}
+
+func uninstallIAP(cmd *cobra.Command, args []string) {
+	scope := parseGitScope()
+
+	var urls []string
+	for _, c := range git.ConfigGetRegexpIn(scope, `^iap\..*\.(helperid|clientid)$`) {
+		if !contains(urls, c.Url) {
+			urls = append(urls, c.Url)
+		}
+	}
+
+	p := newRemovalPlan(scope, urls)
+	for _, url := range urls {
+		p.unconfigure(url)
+	}
+	p.unsetIfSet(&git.GitConfig{Url: helperProtocol(), Section: "protocol", Key: "allow", Value: "always", Scope: scope})
+	p.removeProfile()
+
+	if len(p.Removals) == 0 {
+		log.Info().Msgf("Nothing to uninstall from the %s git config", scope)
+		return
+	}
+	p.run(dryRun)
+}
+
+// unconfigure plans the removal of what 'configure' wrote for a URL, and of its jar and tokens.
+// It reports whether the URL is configured in the scope of the plan.
+func (p *removalPlan) unconfigure(url string) bool {
+	entry := func(section, url, key string) *git.GitConfig {
+		return &git.GitConfig{Url: url, Section: section, Key: key, Scope: p.ConfigScope}
+	}
+	helperID, helperSecret, clientID, acct := entry("iap", url, "helperID"), entry("iap", url, "helperSecret"), entry("iap", url, "clientID"), entry("iap", url, "account")
+	cookieFile, autoEnroll := entry("http", url, "cookieFile"), entry("iap", url, "autoEnroll")
+
+	// tokens are located with the config being removed, before it is unset
+	account := iap.Account(url)
+	var store iap.TokenStore
+	removesTokens := false
+
+	found := false
+	for _, c := range []*git.GitConfig{helperID, helperSecret, clientID, acct, cookieFile, autoEnroll} {
+		found = p.unsetIfSet(c) || found
+	}
+	if !found {
+		return false
+	}
+
+	p.removeJar(cookieFile.Value)
+
+	// the insteadOf mapping is shared by every URL of the host
+	if host, err := urlHost(url); err == nil && !p.hostStillConfigured(host) {
+		p.unsetIfSet(&git.GitConfig{Url: helperProtocol() + "://" + host, Section: "url", Key: "insteadOf", Value: fmt.Sprintf("https://%s", host), Scope: p.ConfigScope})
+		if strings.Contains(host, "*") {
+			p.unenroll(host)
+		}
+	}
+
+	if clientID.Value != "" {
+		removesTokens = true
+		p.add(fmt.Sprintf("erase the IAP auth token cached for audience %s, account %s", clientID.Value, account), func() error {
+			if err := iap.EraseAudienceToken(store, clientID.Value, account); err != nil {
+				log.Debug().Msgf("[unconfigure] No cached IAP auth token to erase for %s: %s", url, err)
+			}
+			return nil
+		})
+	}
+
+	if helperID.Value != "" {
+		if users := p.stillUsing(`^iap\..*\.helperid$`, func(c *git.GitConfig) bool {
+			return c.Value == helperID.Value && iap.Account(c.Url) == account
+		}); len(users) > 0 {
+			p.keep(fmt.Sprintf("refresh token of helperID=%s,account=%s, still used by %s", helperID.Value, account, strings.Join(users, ", ")))
+		} else {
+			removesTokens = true
+			p.add(fmt.Sprintf("revoke the Google OAuth grant of helperID=%s,account=%s, which signs it out on every machine, and delete its refresh token", helperID.Value, account), func() error {
+				return iap.RevokeRefreshToken(store, url, helperID.Value, account)
+			})
+		}
+	}
+
+	if iap.IsHelperSecretRef(helperSecret.Value) {
+		id := strings.TrimPrefix(helperSecret.Value, iap.HelperSecretRefPrefix)
+		if users := p.stillUsing(`^iap\..*\.helpersecret$`, func(c *git.GitConfig) bool {
+			return c.Value == helperSecret.Value
+		}); len(users) > 0 {
+			p.keep(fmt.Sprintf("helperSecret of helperID=%s, still used by %s", id, strings.Join(users, ", ")))
+		} else {
+			removesTokens = true
+			p.add(fmt.Sprintf("delete the helperSecret of helperID=%s from the token store", id), func() error {
+				return iap.EraseHelperSecret(store, id)
+			})
+		}
+	}
+
+	// the store is only needed to run the removals, not to list them
+	if removesTokens && !dryRun {
+		var err error
+		if store, err = iap.NewTokenStore(url); err != nil {
+			log.Fatal().Msgf("Could not open the token store of %s: %s", url, err)
+		}
+	}
+	return true
+}
+
+// unsetIfSet plans to unset a config entry when it is set in the scope of the plan, reading its value into c.
+// If c has a Value, the entry is only unset when it holds that value.
+func (p *removalPlan) unsetIfSet(c *git.GitConfig) bool {
+	expected := c.Value
+	if !git.ConfigGetIn(c) || (expected != "" && c.Value != expected) {
+		return false
+	}
+	p.unset[strings.ToLower(c.Name())] = true
+	value := c.Value
+	if c.Key == "helperSecret" && !iap.IsHelperSecretRef(value) {
+		value = "<secret>"
+	}
+	p.add(fmt.Sprintf("unset %s (%s)", c.Name(), value), func() error {
+		git.UnsetConfig(c)
+		return nil
+	})
+	return true
+}
+
+// removeJar plans the deletion of a cookie jar, if it exists.
+func (p *removalPlan) removeJar(cookieFile string) {
+	if cookieFile == "" {
+		return
+	}
+	jar := iap.ExpandHome(cookieFile)
+	if _, err := os.Stat(jar); err == nil {
+		p.add(fmt.Sprintf("delete cookie jar %s", jar), func() error { return os.Remove(jar) })
+	}
+}
+
+// unenroll plans the removal of the insteadOf mappings and cookie jars of the hosts matching a wildcard host,
+// as written by autoEnroll or set by hand, unless these hosts have their own IAP config.
+func (p *removalPlan) unenroll(wildcard string) {
+	for _, c := range git.ConfigGetRegexpIn(p.ConfigScope, `^(url\..*\.insteadof|http\..*\.cookiefile)$`) {
+		host, err := urlHost(c.Url)
+		if err != nil || strings.Contains(host, "*") || !matchesWildcard(wildcard, host) || p.hostStillConfigured(host) {
+			continue
+		}
+		switch {
+		case c.Section == "url" && c.Url == helperProtocol()+"://"+host && c.Value == "https://"+host:
+			p.unsetIfSet(&git.GitConfig{Url: c.Url, Section: "url", Key: "insteadOf", Value: c.Value, Scope: p.ConfigScope})
+		case c.Section == "http" && c.Url == "https://"+host:
+			if p.unsetIfSet(&git.GitConfig{Url: c.Url, Section: "http", Key: "cookieFile", Value: c.Value, Scope: p.ConfigScope}) {
+				p.removeJar(c.Value)
+			}
+		}
+	}
+}
+
+// hostStillConfigured reports whether URLs of a host that are not being unconfigured remain in the scope of the plan.
+func (p *removalPlan) hostStillConfigured(host string) bool {
+	for _, c := range git.ConfigGetRegexpIn(p.ConfigScope, `^iap\..*\.(helperid|clientid)$`) {
+		if h, err := urlHost(c.Url); err == nil && h == host && !p.urls[c.Url] {
+			return true
+		}
+	}
+	return false
+}
+
+// stillUsing returns the URLs, in any scope, that are not being unconfigured and have an entry
+// matching both pattern and match.
+func (p *removalPlan) stillUsing(pattern string, match func(*git.GitConfig) bool) []string {
+	var users []string
+	for _, c := range git.ConfigGetRegexp(pattern) {
+		if !p.urls[c.Url] && !contains(users, c.Url) && match(c) {
+			users = append(users, c.Url)
+		}
+	}
+	return users
+}
+
+// removeProfile plans the removal of the profile of an includeIf scope, and of its include,
+// once nothing is left in it.
+func (p *removalPlan) removeProfile() {
+	include := p.ConfigScope.Include()
+	if include == nil {
+		return
+	}
+	for _, name := range git.ConfigNamesIn(p.ConfigScope) {
+		if !p.unset[strings.ToLower(name)] {
+			return
+		}
+	}
+
+	include.Scope = git.ConfigScope{Kind: git.ScopeGlobal}
+	p.unsetIfSet(include)
+	file := p.ConfigScope.File
+	if _, err := os.Stat(file); err == nil {
+		p.add(fmt.Sprintf("delete profile %s", file), func() error { return os.Remove(file) })
+	}
+}
+
+func (p *removalPlan) add(description string, do func() error) {
+	if p.seen[description] {
+		return
+	}
+	p.seen[description] = true
+	p.Removals = append(p.Removals, &removal{Description: description, Do: do})
+}
+
+func (p *removalPlan) keep(description string) {
+	if !contains(p.Kept, description) {
+		p.Kept = append(p.Kept, description)
+	}
+}
+
+// print lists the removals of a removalPlan, and what it keeps.
+func (p *removalPlan) print(w io.Writer) {
+	fmt.Fprintf(w, "# %s git config\n", p.ConfigScope)
+	for _, r := range p.Removals {
+		fmt.Fprintf(w, "  - %s\n", r.Description)
+	}
+	for _, k := range p.Kept {
+		fmt.Fprintf(w, "  # keeping the %s\n", k)
+	}
+}
+
+// run makes the removals of a removalPlan, or only lists them with dryRun.
+// Failing to remove tokens is reported, but does not stop the removal of the config.
+func (p *removalPlan) run(dryRun bool) {
+	if dryRun {
+		p.print(os.Stdout)
+		return
+	}
+
+	for _, r := range p.Removals {
+		log.Info().Msg(r.Description)
+		if err := r.Do(); err != nil {
+			log.Warn().Msgf("Could not %s: %s", r.Description, err)
+		}
+	}
+	for _, k := range p.Kept {
+		log.Info().Msgf("Keeping the %s", k)
+	}
+}
+
+// helperProtocol returns the protocol handled by the helper, as allowed by 'install'.
+func helperProtocol() string {
+	return strings.TrimPrefix(filepath.Base(binaryName), "git-remote-")
+}
+
+// urlHost returns the host a URL is configured for.
+func urlHost(url string) (string, error) {
+	_, scope, err := configScope(url, false)
+	return strings.TrimPrefix(scope, "https://"), err
+}
+
+// matchesWildcard reports whether a host matches a wildcard host, where '*' stands for one label, as in Git's URL matching.
+func matchesWildcard(wildcard, host string) bool {
+	patterns, labels := strings.Split(wildcard, "."), strings.Split(host, ".")
+	if len(patterns) != len(labels) {
+		return false
+	}
+	for i, pattern := range patterns {
+		if pattern != "*" && !strings.EqualFold(pattern, labels[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+)
+
+// newTestHome points git and the token stores at an empty home directory, and names the binary
+// as installed, for helperProtocol.
+func newTestHome(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(home, ".gitconfig"))
+
+	name := binaryName
+	binaryName = "git-remote-https+iap"
+	t.Cleanup(func() { binaryName = name })
+	return home
+}
+
+// gitConfig runs 'git config' with args.
+func gitConfig(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"config"}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git config %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// configureTestHost writes what 'configure' writes for a URL in the global config.
+func configureTestHost(t *testing.T, url, clientID, helperID string) {
+	t.Helper()
+	host := strings.TrimPrefix(url, "https://")
+	gitConfig(t, "--global", "iap."+url+".helperID", helperID)
+	gitConfig(t, "--global", "iap."+url+".helperSecret", iap.HelperSecretRefPrefix+helperID)
+	gitConfig(t, "--global", "iap."+url+".clientID", clientID)
+	gitConfig(t, "--global", "http."+url+".cookieFile", "~/.config/gcp-iap/"+host+".cookie")
+	gitConfig(t, "--global", "url.https+iap://"+host+".insteadOf", url)
+}
+
+// describe returns the descriptions of the removals of a plan, and what it keeps.
+func describe(p *removalPlan) string {
+	var lines []string
+	for _, r := range p.Removals {
+		lines = append(lines, r.Description)
+	}
+	for _, k := range p.Kept {
+		lines = append(lines, "keep "+k)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestUnconfigure(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// urls are unconfigured together
+		urls     []string
+		want     []string
+		dontWant []string
+	}{
+		{
+			name: "host sharing its helper",
+			urls: []string{"https://a.example.com"},
+			want: []string{
+				"unset iap.https://a.example.com.helperID (helper-1)",
+				"unset iap.https://a.example.com.clientID (client-a)",
+				"unset http.https://a.example.com.cookieFile",
+				"unset url.https+iap://a.example.com.insteadOf (https://a.example.com)",
+				"erase the IAP auth token cached for audience client-a",
+				"keep refresh token of helperID=helper-1,account=default, still used by https://b.example.com",
+				"keep helperSecret of helperID=helper-1, still used by https://b.example.com",
+			},
+			dontWant: []string{"b.example.com.", "revoke", "delete the helperSecret"},
+		},
+		{
+			name: "every host of the helper",
+			urls: []string{"https://a.example.com", "https://b.example.com"},
+			want: []string{
+				"unset iap.https://b.example.com.helperID (helper-1)",
+				"revoke the Google OAuth grant of helperID=helper-1,account=default",
+				"delete the helperSecret of helperID=helper-1 from the token store",
+			},
+			dontWant: []string{"keep", "helper-2"},
+		},
+		{
+			name: "host of its own",
+			urls: []string{"https://c.example.com"},
+			want: []string{
+				"revoke the Google OAuth grant of helperID=helper-2,account=default",
+				"delete the helperSecret of helperID=helper-2 from the token store",
+			},
+			dontWant: []string{"keep", "helper-1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newTestHome(t)
+			configureTestHost(t, "https://a.example.com", "client-a", "helper-1")
+			configureTestHost(t, "https://b.example.com", "client-b", "helper-1")
+			configureTestHost(t, "https://c.example.com", "client-c", "helper-2")
+
+			p := newRemovalPlan(git.ConfigScope{Kind: git.ScopeGlobal}, tc.urls)
+			for _, url := range tc.urls {
+				if !p.unconfigure(url) {
+					t.Fatalf("%s is not configured", url)
+				}
+			}
+			got := describe(p)
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("plan does not %s:\n%s", want, got)
+				}
+			}
+			for _, dontWant := range tc.dontWant {
+				if strings.Contains(got, dontWant) {
+					t.Errorf("plan mentions %q:\n%s", dontWant, got)
+				}
+			}
+		})
+	}
+}
+
+func TestUnconfigureRun(t *testing.T) {
+	newTestHome(t)
+	configureTestHost(t, "https://a.example.com", "client-a", "helper-1")
+	configureTestHost(t, "https://b.example.com", "client-b", "helper-1")
+
+	p := newRemovalPlan(git.ConfigScope{Kind: git.ScopeGlobal}, []string{"https://a.example.com"})
+	p.unconfigure("https://a.example.com")
+	p.run(false)
+
+	if out, _ := exec.Command("git", "config", "--global", "--get-regexp", "a\\.example\\.com").Output(); len(out) > 0 {
+		t.Errorf("config of a.example.com left behind:\n%s", out)
+	}
+	if got := gitConfig(t, "--global", "iap.https://b.example.com.helperSecret"); got != iap.HelperSecretRefPrefix+"helper-1" {
+		t.Errorf("helperSecret of b.example.com = %q, want it kept", got)
+	}
+	if p.unconfigure("https://a.example.com") {
+		t.Error("a.example.com is still configured after unconfigure")
+	}
+}
+
+func TestUnconfigureWildcard(t *testing.T) {
+	newTestHome(t)
+	configureTestHost(t, "https://*.example.com", "client-w", "helper-1")
+	// enrolled on first use
+	for _, host := range []string{"foo.example.com", "bar.example.com"} {
+		gitConfig(t, "--global", "url.https+iap://"+host+".insteadOf", "https://"+host)
+		gitConfig(t, "--global", "http.https://"+host+".cookieFile", "~/.config/gcp-iap/"+host+".cookie")
+	}
+	// configured on its own, and kept
+	configureTestHost(t, "https://bar.example.com", "client-b", "helper-2")
+	// not matched by the wildcard
+	gitConfig(t, "--global", "url.https+iap://foo.bar.example.com.insteadOf", "https://foo.bar.example.com")
+
+	p := newRemovalPlan(git.ConfigScope{Kind: git.ScopeGlobal}, []string{"https://*.example.com"})
+	if !p.unconfigure("https://*.example.com") {
+		t.Fatal("https://*.example.com is not configured")
+	}
+	got := describe(p)
+	for _, want := range []string{
+		"unset url.https+iap://*.example.com.insteadOf (https://*.example.com)",
+		"unset url.https+iap://foo.example.com.insteadOf (https://foo.example.com)",
+		"unset http.https://foo.example.com.cookieFile",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("plan does not %s:\n%s", want, got)
+		}
+	}
+	for _, dontWant := range []string{"bar.example.com"} {
+		if strings.Contains(got, dontWant) {
+			t.Errorf("plan mentions %q:\n%s", dontWant, got)
+		}
+	}
+}
+
+func TestRemoveProfile(t *testing.T) {
+	home := newTestHome(t)
+	profile := filepath.Join(home, "work.gitconfig")
+	scope := git.ConfigScope{Kind: git.ScopeIncludeIf, GitDir: "~/work/", File: profile}
+	gitConfig(t, "--global", "includeIf.gitdir:~/work/.path", profile)
+	gitConfig(t, "--file", profile, "iap.https://a.example.com.helperID", "helper-1")
+	gitConfig(t, "--file", profile, "iap.https://a.example.com.clientID", "client-a")
+
+	for _, tc := range []struct {
+		name        string
+		other       bool
+		wantRemoved bool
+	}{
+		{"empty profile", false, true},
+		{"profile with other entries", true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.other {
+				gitConfig(t, "--file", profile, "user.email", "me@example.com")
+				defer gitConfig(t, "--file", profile, "--unset", "user.email")
+			}
+			p := newRemovalPlan(scope, []string{"https://a.example.com"})
+			p.unconfigure("https://a.example.com")
+			p.removeProfile()
+
+			got := describe(p)
+			for _, want := range []string{"unset includeIf.gitdir:~/work/.path", "delete profile " + profile} {
+				if strings.Contains(got, want) != tc.wantRemoved {
+					t.Errorf("plan %s %s: %t, want %t\n%s", tc.name, want, !tc.wantRemoved, tc.wantRemoved, got)
+				}
+			}
+		})
+	}
+
+	if _, err := os.Stat(profile); err != nil {
+		t.Errorf("planning removed the profile: %s", err)
+	}
+
+	// the include of a profile that is gone is still removed
+	gone := filepath.Join(home, "gone.gitconfig")
+	gitConfig(t, "--global", "includeIf.gitdir:~/gone/.path", gone)
+	p := newRemovalPlan(git.ConfigScope{Kind: git.ScopeIncludeIf, GitDir: "~/gone/", File: gone}, nil)
+	p.removeProfile()
+	if got := describe(p); got != "unset includeIf.gitdir:~/gone/.path ("+gone+")" {
+		t.Errorf("plan for a missing profile:\n%s", got)
+	}
+}
+
+func TestMatchesWildcard(t *testing.T) {
+	for _, tc := range []struct {
+		wildcard, host string
+		want           bool
+	}{
+		{"*.example.com", "foo.example.com", true},
+		{"*.example.com", "FOO.Example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "foo.bar.example.com", false},
+		{"*.*.example.com", "foo.bar.example.com", true},
+		{"git.example.com", "git.example.com", true},
+		{"git.example.com", "gitx.example.com", false},
+		{"*.example.com", "foo.example.org", false},
+	} {
+		if got := matchesWildcard(tc.wildcard, tc.host); got != tc.want {
+			t.Errorf("matchesWildcard(%s, %s) = %t, want %t", tc.wildcard, tc.host, got, tc.want)
+		}
+	}
+}
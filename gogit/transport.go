@@ -0,0 +1,145 @@
+// Package gogit lets tools built on go-git clone, fetch and push IAP protected repositories,
+// with the same configuration and tokens as git-remote-https+iap.
+//
+// The configuration written by 'git-remote-https+iap configure' is still read with 'git config',
+// but the git binary is not used to talk to the repositories.
+//
+// Logs are disabled, unless GIT_IAP_VERBOSE is set or the program passes a logger to SetLogger.
+// Errors are returned to go-git, the program is never exited.
+package gogit
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+	"github.com/adohkan/git-remote-https-iap/internal/proxy"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Protocol is the scheme of the URLs handled by git-remote-https+iap.
+	Protocol = "https+iap"
+
+	// DebugEnvVariable is the name of the environment variable that needs to be set in order to enable debug logging
+	DebugEnvVariable = "GIT_IAP_VERBOSE"
+)
+
+func init() {
+	if debug, _ := strconv.ParseBool(os.Getenv(DebugEnvVariable)); debug {
+		SetLogger(zerolog.New(os.Stderr).With().Timestamp().Logger())
+	}
+}
+
+// SetLogger sets the logger used for the logs of the package, which are disabled by default.
+// The global level of zerolog applies to it.
+func SetLogger(l zerolog.Logger) {
+	log.Logger = l
+}
+
+// A Transport is a go-git transport.Transport authenticating with IAP the repositories configured
+// for it, over smart HTTP. IAP auth tokens are shared with git-remote-https+iap, and refreshed ahead of their expiry.
+// It is safe for concurrent use.
+type Transport struct {
+	// Fallback, if not nil, handles the repositories that are not configured for IAP.
+	// Otherwise, they are refused.
+	Fallback transport.Transport
+
+	// newSource returns the TokenSource of a URL, proxy.NewTokenSource when nil.
+	newSource func(url string) oauth2.TokenSource
+
+	mu        sync.Mutex
+	audiences map[string]string
+	sources   map[string]oauth2.TokenSource
+}
+
+// Install registers a Transport for https+iap:// URLs in go-git's client registry.
+func Install() {
+	client.InstallProtocol(Protocol, &Transport{})
+}
+
+// InstallHTTPS registers a Transport for https:// URLs in go-git's client registry, so that URLs
+// configured for IAP work without being rewritten to https+iap://. Other URLs use go-git's default HTTP transport.
+func InstallHTTPS() {
+	client.InstallProtocol("https", &Transport{Fallback: githttp.DefaultClient})
+}
+
+// NewUploadPackSession implements transport.Transport.
+func (t *Transport) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	c, ep, err := t.client(ep)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewUploadPackSession(ep, auth)
+}
+
+// NewReceivePackSession implements transport.Transport.
+func (t *Transport) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	c, ep, err := t.client(ep)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewReceivePackSession(ep, auth)
+}
+
+// client returns the transport to use for an endpoint, along with the endpoint in https://.
+func (t *Transport) client(ep *transport.Endpoint) (transport.Transport, *transport.Endpoint, error) {
+	https := *ep
+	https.Protocol = "https"
+
+	// config is resolved against the whole URL, without credentials
+	anonymous := https
+	anonymous.User, anonymous.Password = "", ""
+	url := anonymous.String()
+
+	if err := iap.CheckConfig(url); err != nil {
+		if t.Fallback != nil {
+			return t.Fallback, ep, nil
+		}
+		return nil, nil, fmt.Errorf("[gogit.Transport] %w", err)
+	}
+	source, err := t.source(url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[gogit.Transport] %w", err)
+	}
+	return githttp.NewClient(iapauth.NewClient(source)), &https, nil
+}
+
+// source returns the TokenSource of a URL. URLs sharing the same audience and account share the same source.
+func (t *Transport) source(url string) (oauth2.TokenSource, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.audiences == nil {
+		t.audiences = map[string]string{}
+		t.sources = map[string]oauth2.TokenSource{}
+	}
+
+	key, ok := t.audiences[url]
+	if !ok {
+		var err error
+		if key, err = iap.TokenKey(url); err != nil {
+			return nil, err
+		}
+		t.audiences[url] = key
+	}
+	source, ok := t.sources[key]
+	if !ok {
+		log.Debug().Msgf("[gogit.Transport] New token source for %s (%s)", url, key)
+		if t.newSource != nil {
+			source = t.newSource(url)
+		} else {
+			source = proxy.NewTokenSource(url, nil)
+		}
+		t.sources[key] = source
+	}
+	return source, nil
+}
@@ -0,0 +1,188 @@
+package gogit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/iaptest"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"golang.org/x/oauth2"
+)
+
+const headHash = "0123456789abcdef0123456789abcdef01234567"
+
+// setupGitConfig points git at an empty global config, and configures IAP for each URL with its client ID.
+func setupGitConfig(t *testing.T, clientIDs map[string]string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	for url, clientID := range clientIDs {
+		for key, value := range map[string]string{
+			"iap.helperID":     "helper-id",
+			"iap.helperSecret": "helper-secret",
+			"iap.clientID":     clientID,
+			"http.cookieFile":  home + "/cookie",
+		} {
+			section := strings.SplitN(key, ".", 2)
+			name := fmt.Sprintf("%s.%s.%s", section[0], url, section[1])
+			if out, err := exec.Command("git", "config", "--global", name, value).CombinedOutput(); err != nil {
+				t.Fatalf("git config %s: %s\n%s", name, err, out)
+			}
+		}
+	}
+}
+
+// newIAPStandIn returns a TLS server that only accepts "token-2", and bounces other requests
+// to the Google sign-in page, like IAP. It advertises a single ref for git-upload-pack.
+// The default HTTP transport trusts it until the end of the test.
+func newIAPStandIn(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(iapauth.DefaultHeader) != "Bearer token-2" {
+			http.Redirect(w, r, "https://accounts.google.com/o/oauth2/v2/auth", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		fmt.Fprint(w, pktLine("# service=git-upload-pack\n"), "0000")
+		fmt.Fprint(w, pktLine(headHash+" HEAD\x00symref=HEAD:refs/heads/main\n"), pktLine(headHash+" refs/heads/main\n"), "0000")
+	}))
+	t.Cleanup(srv.Close)
+
+	base := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = base })
+	return srv
+}
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// stubTransport is a transport.Transport recording that it was used.
+type stubTransport struct {
+	used int
+}
+
+var errStub = errors.New("stub transport")
+
+func (s *stubTransport) NewUploadPackSession(*transport.Endpoint, transport.AuthMethod) (transport.UploadPackSession, error) {
+	s.used++
+	return nil, errStub
+}
+
+func (s *stubTransport) NewReceivePackSession(*transport.Endpoint, transport.AuthMethod) (transport.ReceivePackSession, error) {
+	s.used++
+	return nil, errStub
+}
+
+func TestTransportIAP(t *testing.T) {
+	srv := newIAPStandIn(t)
+	setupGitConfig(t, map[string]string{srv.URL: "client-a"})
+
+	fallback := &stubTransport{}
+	source := &iaptest.RotatingSource{}
+	tr := &Transport{Fallback: fallback, newSource: func(string) oauth2.TokenSource { return source }}
+
+	ep, err := transport.NewEndpoint(strings.Replace(srv.URL, "https://", "https+iap://", 1) + "/repo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := tr.NewUploadPackSession(ep, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	refs, err := session.AdvertisedReferences()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head, ok := refs.References["refs/heads/main"]; !ok || head.String() != headHash {
+		t.Errorf("got refs/heads/main %v, want %s", head, headHash)
+	}
+	if source.Invalidated() != 1 {
+		t.Errorf("the refused token was invalidated %d times, want 1", source.Invalidated())
+	}
+	if fallback.used != 0 {
+		t.Errorf("an IAP URL was handed to the fallback transport")
+	}
+}
+
+func TestTransportFallback(t *testing.T) {
+	setupGitConfig(t, map[string]string{"https://iap.example.com": "client-a"})
+
+	ep, err := transport.NewEndpoint("https://git.example.com/repo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fallback := &stubTransport{}
+	tr := &Transport{Fallback: fallback, newSource: func(string) oauth2.TokenSource {
+		t.Error("a token source was created for a URL that is not configured for IAP")
+		return &iaptest.RotatingSource{}
+	}}
+	if _, err := tr.NewUploadPackSession(ep, nil); err != errStub {
+		t.Errorf("got %v, want the error of the fallback transport", err)
+	}
+	if _, err := tr.NewReceivePackSession(ep, nil); err != errStub {
+		t.Errorf("got %v, want the error of the fallback transport", err)
+	}
+	if fallback.used != 2 {
+		t.Errorf("the fallback transport was used %d times, want 2", fallback.used)
+	}
+
+	tr.Fallback = nil
+	if _, err := tr.NewUploadPackSession(ep, nil); err == nil || !strings.Contains(err.Error(), "not configured for IAP") {
+		t.Errorf("got %v, want the URL to be refused", err)
+	}
+}
+
+func TestTransportSourcePerAudience(t *testing.T) {
+	setupGitConfig(t, map[string]string{
+		"https://a.example.com": "client-a",
+		"https://b.example.com": "client-a",
+		"https://c.example.com": "client-c",
+	})
+
+	created := map[string]int{}
+	tr := &Transport{newSource: func(url string) oauth2.TokenSource {
+		created[url]++
+		return &iaptest.RotatingSource{}
+	}}
+	sources := map[string]oauth2.TokenSource{}
+	for _, url := range []string{
+		"https://a.example.com/repo.git",
+		"https://a.example.com/other.git",
+		"https://b.example.com/repo.git",
+		"https://c.example.com/repo.git",
+	} {
+		s, err := tr.source(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[url] = s
+	}
+
+	if sources["https://a.example.com/repo.git"] != sources["https://a.example.com/other.git"] ||
+		sources["https://a.example.com/repo.git"] != sources["https://b.example.com/repo.git"] {
+		t.Error("URLs with the same audience got different token sources")
+	}
+	if sources["https://a.example.com/repo.git"] == sources["https://c.example.com/repo.git"] {
+		t.Error("URLs with different audiences share a token source")
+	}
+	if len(created) != 2 {
+		t.Errorf("%d token sources were created, want 2: %v", len(created), created)
+	}
+}
@@ -0,0 +1,67 @@
+package iapauth
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/int128/oauth2cli"
+	"github.com/pkg/browser"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/errgroup"
+)
+
+// BrowserFlow is a CredentialSource that runs an OAuth login workflow in the browser of the user
+// every time it is asked for a refresh token. It is usually combined with a cache of refresh tokens.
+// see: https://github.com/int128/oauth2cli/blob/master/example/main.go
+type BrowserFlow struct {
+	// Open opens a URL in the browser. It defaults to the browser of the system.
+	// When it fails, the URL is printed on stderr instead.
+	Open func(url string) error
+}
+
+// RefreshToken implements CredentialSource.
+func (f *BrowserFlow) RefreshToken(ctx context.Context, client *oauth2.Config) (string, error) {
+	open := f.Open
+	if open == nil {
+		open = browser.OpenURL
+	}
+
+	ready := make(chan string, 1)
+	var eg errgroup.Group
+	var token *oauth2.Token
+
+	eg.Go(func() error {
+		select {
+		case url, ok := <-ready:
+			if !ok {
+				return nil
+			}
+			if err := open(url); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not open the browser (%s), please open %s\n", err, url)
+			}
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("[BrowserFlow] Context done while waiting for authorization: %w", ctx.Err())
+		}
+	})
+
+	eg.Go(func() error {
+		defer close(ready)
+
+		var err error
+		token, err = oauth2cli.GetToken(ctx, oauth2cli.Config{
+			OAuth2Config:         *client,
+			LocalServerReadyChan: ready,
+		})
+		if err != nil {
+			return fmt.Errorf("[BrowserFlow] Could not get 'access_token' for the desktop-app: %w", err)
+		}
+		return nil
+	})
+
+	if err := eg.Wait(); err != nil {
+		return "", err
+	}
+	return token.RefreshToken, nil
+}
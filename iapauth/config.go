@@ -0,0 +1,96 @@
+// Package iapauth gets ID tokens for services protected by GCP Identity Aware Proxy (IAP),
+// and authenticates HTTP requests with them.
+//
+// It is what git-remote-https+iap is built on, but does not depend on Git:
+// everything it needs is passed in a Config.
+package iapauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Config describes how to get ID tokens for an IAP protected service.
+type Config struct {
+	// ClientID is the OAuth Client ID of the IAP instance, which is the audience of the ID tokens.
+	ClientID string
+
+	// HelperID and HelperSecret identify the OAuth Client (of type 'Desktop app')
+	// whose refresh tokens are exchanged for ID tokens.
+	HelperID     string
+	HelperSecret string
+
+	// Credentials supplies the refresh tokens of the helper's OAuth Client.
+	Credentials CredentialSource
+
+	// Cache optionally keeps ID tokens beyond the lifetime of a TokenSource, under CacheKey.
+	// CacheKey defaults to ClientID, so that every service behind the same IAP backend shares them.
+	Cache    TokenCache
+	CacheKey string
+
+	// RefreshAhead is how long before its expiry an ID token gets replaced.
+	// When zero, ID tokens are used until they expire.
+	RefreshAhead time.Duration
+
+	// TokenURL is the endpoint exchanging refresh tokens for ID tokens. It defaults to Google's.
+	TokenURL string
+
+	// HTTPClient is used to call TokenURL. It defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// A CredentialSource supplies refresh tokens for an OAuth Client.
+type CredentialSource interface {
+	RefreshToken(ctx context.Context, client *oauth2.Config) (string, error)
+}
+
+// StaticRefreshToken is a CredentialSource that always returns the same refresh token,
+// for instance one obtained beforehand and kept in a secret manager.
+type StaticRefreshToken string
+
+// RefreshToken implements CredentialSource.
+func (t StaticRefreshToken) RefreshToken(ctx context.Context, client *oauth2.Config) (string, error) {
+	return string(t), nil
+}
+
+// A TokenCache keeps ID tokens, for instance across processes.
+type TokenCache interface {
+	// Get returns the token saved under key, or an error if there is none.
+	Get(key string) (*oauth2.Token, error)
+	// Put saves a token under key.
+	Put(key string, token *oauth2.Token) error
+}
+
+// MemoryCache is a TokenCache keeping ID tokens in memory. It is safe for concurrent use.
+type MemoryCache struct {
+	mu     sync.Mutex
+	tokens map[string]*oauth2.Token
+}
+
+// Get implements TokenCache.
+func (c *MemoryCache) Get(key string) (*oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.tokens[key]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("[MemoryCache] No token for %s", key)
+}
+
+// Put implements TokenCache.
+func (c *MemoryCache) Put(key string, token *oauth2.Token) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokens == nil {
+		c.tokens = map[string]*oauth2.Token{}
+	}
+	c.tokens[key] = token
+	return nil
+}
@@ -0,0 +1,45 @@
+package iapauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RevokeURL is the endpoint revoking refresh tokens issued by Google.
+// see: https://developers.google.com/identity/protocols/oauth2/native-app#tokenrevoke
+const RevokeURL = "https://oauth2.googleapis.com/revoke"
+
+// Revoke revokes a refresh token at RevokeURL, so that it can no longer be exchanged for ID tokens.
+// A token Google does not know, e.g. already revoked, is not an error. client defaults to http.DefaultClient.
+func Revoke(ctx context.Context, client *http.Client, refreshToken string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	form := url.Values{"token": {refreshToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, RevokeURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("[Revoke] Could not revoke refresh token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error     string `json:"error"`
+		ErrorDesc string `json:"error_description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK && result.Error != "invalid_token" {
+		return fmt.Errorf("[Revoke] Could not revoke refresh token: HTTP %d: %s (%s)", resp.StatusCode, result.Error, result.ErrorDesc)
+	}
+	return nil
+}
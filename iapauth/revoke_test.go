@@ -0,0 +1,55 @@
+package iapauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// redirectTransport sends every request to a test server instead of its host.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t *redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestRevoke(t *testing.T) {
+	revoked := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/revoke" || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch token := r.FormValue("token"); token {
+		case "valid":
+			revoked[token] = true
+		case "unknown":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_token", "error_description": "Token expired or revoked"}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"error": "internal_failure"}`)
+		}
+	}))
+	defer srv.Close()
+
+	target, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &redirectTransport{target: target}}
+
+	if err := Revoke(context.Background(), client, "valid"); err != nil || !revoked["valid"] {
+		t.Errorf("Revoke of a valid token: %v", err)
+	}
+	if err := Revoke(context.Background(), client, "unknown"); err != nil {
+		t.Errorf("Revoke of a token Google does not know should succeed, got %s", err)
+	}
+	if err := Revoke(context.Background(), client, "failure"); err == nil {
+		t.Error("Revoke should fail when the endpoint does")
+	}
+}
@@ -0,0 +1,188 @@
+package iapauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// IDTokenExtra is the key of the raw ID token in the extra fields of the tokens returned by a TokenSource.
+const IDTokenExtra = "id_token"
+
+// A TokenSource is an oauth2.TokenSource returning IAP ID tokens for a Config.
+// The ID token is the AccessToken of the returned tokens, so that they can be used
+// with oauth2.Transport, and is also available as their IDTokenExtra extra field.
+// It is safe for concurrent use.
+type TokenSource struct {
+	ctx    context.Context
+	config Config
+
+	mu        sync.Mutex
+	token     *oauth2.Token
+	skipCache bool
+}
+
+// NewTokenSource returns a TokenSource for a Config. ctx is used to get refresh tokens
+// from the Credentials of the Config, and to exchange them.
+func NewTokenSource(ctx context.Context, config Config) *TokenSource {
+	return &TokenSource{ctx: ctx, config: config}
+}
+
+// Token returns an ID token that is valid for at least RefreshAhead, reusing the current
+// or cached one when possible. It implements oauth2.TokenSource.
+func (s *TokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.valid(s.token) {
+		return s.token, nil
+	}
+	if s.config.Cache != nil && !s.skipCache {
+		if t, err := s.config.Cache.Get(s.cacheKey()); err == nil && s.valid(t) {
+			s.token = t
+			return t, nil
+		}
+	}
+	return s.mint()
+}
+
+// Refresh always returns a new ID token, ignoring the current and cached ones.
+func (s *TokenSource) Refresh() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mint()
+}
+
+// Invalidate drops a token that IAP refused, so that the next call to Token returns a new one.
+// It is a no-op if the token has already been replaced.
+func (s *TokenSource) Invalidate(token *oauth2.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && token != nil && s.token.AccessToken == token.AccessToken {
+		s.token = nil
+		s.skipCache = true
+	}
+}
+
+func (s *TokenSource) valid(t *oauth2.Token) bool {
+	return t != nil && t.AccessToken != "" && time.Now().Add(s.config.RefreshAhead).Before(t.Expiry)
+}
+
+func (s *TokenSource) cacheKey() string {
+	if s.config.CacheKey != "" {
+		return s.config.CacheKey
+	}
+	return s.config.ClientID
+}
+
+// mint exchanges a refresh token for a new ID token. Errors saving it in the Cache are ignored,
+// as the token is still usable.
+func (s *TokenSource) mint() (*oauth2.Token, error) {
+	if s.config.Credentials == nil {
+		return nil, fmt.Errorf("[TokenSource] No Credentials to get ID tokens for %s", s.config.ClientID)
+	}
+
+	client := s.oauth2Config()
+	refreshToken, err := s.config.Credentials.RefreshToken(s.ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.exchange(client, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	s.token = token
+	s.skipCache = false
+	if s.config.Cache != nil {
+		s.config.Cache.Put(s.cacheKey(), token)
+	}
+	return token, nil
+}
+
+func (s *TokenSource) oauth2Config() *oauth2.Config {
+	endpoint := google.Endpoint
+	if s.config.TokenURL != "" {
+		endpoint.TokenURL = s.config.TokenURL
+	}
+	return &oauth2.Config{
+		ClientID:     s.config.HelperID,
+		ClientSecret: s.config.HelperSecret,
+		Endpoint:     endpoint,
+		Scopes:       []string{"openid", "email"},
+	}
+}
+
+// exchange gets an ID token for the audience of the IAP instance, using a refresh token.
+// see: https://cloud.google.com/iap/docs/authentication-howto#authenticating_from_a_desktop_app
+func (s *TokenSource) exchange(client *oauth2.Config, refreshToken string) (*oauth2.Token, error) {
+	var result struct {
+		IDToken   string `json:"id_token"`
+		Error     string `json:"error"`
+		ErrorDesc string `json:"error_description"`
+	}
+
+	httpClient := s.config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	form := url.Values{
+		"client_id":     {client.ClientID},
+		"client_secret": {client.ClientSecret},
+		"refresh_token": {refreshToken},
+		"grant_type":    {"refresh_token"},
+		"audience":      {s.config.ClientID},
+	}
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, client.Endpoint.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("[TokenSource] Could not exchange 'refresh_token' for an IAP ID token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[TokenSource] Could not exchange 'refresh_token' for an IAP ID token: HTTP %d: %s (%s)", resp.StatusCode, result.Error, result.ErrorDesc)
+	}
+	if result.IDToken == "" {
+		return nil, fmt.Errorf("[TokenSource] Could not exchange 'refresh_token' for an IAP ID token: no id_token in response")
+	}
+
+	return ParseIDToken(result.IDToken)
+}
+
+// ParseIDToken returns an oauth2.Token for a raw ID token, like the ones returned by a TokenSource.
+// The signature of the ID token is not verified, this is the job of IAP.
+func ParseIDToken(raw string) (*oauth2.Token, error) {
+	var p jwt.Parser
+	var claims jwt.StandardClaims
+
+	if _, _, err := p.ParseUnverified(raw, &claims); err != nil {
+		return nil, fmt.Errorf("[ParseIDToken] Could not parse ID token: %w", err)
+	}
+
+	token := &oauth2.Token{
+		AccessToken: raw,
+		TokenType:   "Bearer",
+		Expiry:      time.Unix(claims.ExpiresAt, 0),
+	}
+	return token.WithExtra(map[string]interface{}{IDTokenExtra: raw}), nil
+}
@@ -0,0 +1,168 @@
+package iapauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
+)
+
+// newIDToken returns a new ID token for an audience, expiring after d. Its signature is not valid.
+func newIDToken(t *testing.T, audience string, d time.Duration) string {
+	t.Helper()
+	raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Id:        strconv.FormatInt(time.Now().UnixNano(), 10),
+		Audience:  audience,
+		ExpiresAt: time.Now().Add(d).Unix(),
+	}).SignedString([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// A tokenEndpoint stands in for Google's token endpoint, exchanging the refresh token "refresh-token"
+// for ID tokens valid for Lifetime.
+type tokenEndpoint struct {
+	URL      string
+	Lifetime time.Duration
+
+	mu     sync.Mutex
+	minted int
+}
+
+func newTokenEndpoint(t *testing.T) *tokenEndpoint {
+	t.Helper()
+	e := &tokenEndpoint{Lifetime: time.Hour}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh-token" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Bad Request"}`)
+			return
+		}
+		e.mu.Lock()
+		e.minted++
+		e.mu.Unlock()
+		fmt.Fprintf(w, `{"id_token": %q}`, newIDToken(t, r.FormValue("audience"), e.Lifetime))
+	}))
+	t.Cleanup(srv.Close)
+	e.URL = srv.URL
+	return e
+}
+
+func (e *tokenEndpoint) config() Config {
+	return Config{
+		ClientID:    "audience",
+		HelperID:    "helper-id",
+		Credentials: StaticRefreshToken("refresh-token"),
+		TokenURL:    e.URL,
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	e := newTokenEndpoint(t)
+	ts := NewTokenSource(context.Background(), e.config())
+
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Extra(IDTokenExtra) != token.AccessToken {
+		t.Error("the ID token is not available as an extra field")
+	}
+	if !token.Valid() {
+		t.Error("the ID token is not valid")
+	}
+
+	again, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.AccessToken != token.AccessToken || e.minted != 1 {
+		t.Errorf("Token minted %d ID tokens, want the first one to be reused", e.minted)
+	}
+
+	if _, err := ts.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if e.minted != 2 {
+		t.Errorf("Refresh did not mint a new ID token")
+	}
+}
+
+func TestTokenSourceRefreshAhead(t *testing.T) {
+	e := newTokenEndpoint(t)
+	e.Lifetime = time.Minute
+	config := e.config()
+	config.RefreshAhead = 5 * time.Minute
+	ts := NewTokenSource(context.Background(), config)
+
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Token(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e.minted != 2 {
+		t.Errorf("minted %d ID tokens, want one per call to Token for tokens expiring within RefreshAhead", e.minted)
+	}
+}
+
+func TestTokenSourceCache(t *testing.T) {
+	e := newTokenEndpoint(t)
+	config := e.config()
+	config.Cache = &MemoryCache{}
+
+	cached := &oauth2.Token{AccessToken: newIDToken(t, "audience", time.Hour), Expiry: time.Now().Add(time.Hour)}
+	config.Cache.Put("audience", cached)
+
+	ts := NewTokenSource(context.Background(), config)
+	token, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != cached.AccessToken || e.minted != 0 {
+		t.Fatal("Token did not use the cached ID token")
+	}
+
+	// IAP refused the cached token: a new one is minted and cached, instead of reading the cache again
+	ts.Invalidate(token)
+	token, err = ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken == cached.AccessToken || e.minted != 1 {
+		t.Fatal("Token did not mint a new ID token after Invalidate")
+	}
+	if got, _ := config.Cache.Get("audience"); got.AccessToken != token.AccessToken {
+		t.Error("the new ID token was not cached")
+	}
+
+	// a token that was already replaced is ignored
+	ts.Invalidate(cached)
+	if again, _ := ts.Token(); again.AccessToken != token.AccessToken {
+		t.Error("Invalidate of a replaced token dropped the current one")
+	}
+}
+
+func TestTokenSourceErrors(t *testing.T) {
+	e := newTokenEndpoint(t)
+
+	config := e.config()
+	config.Credentials = nil
+	if _, err := NewTokenSource(context.Background(), config).Token(); err == nil {
+		t.Error("Token without Credentials should fail")
+	}
+
+	config = e.config()
+	config.Credentials = StaticRefreshToken("revoked")
+	if _, err := NewTokenSource(context.Background(), config).Token(); err == nil {
+		t.Error("Token with a refresh token refused by the endpoint should fail")
+	}
+}
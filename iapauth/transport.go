@@ -0,0 +1,111 @@
+package iapauth
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// DefaultHeader is the header carrying the ID token, which leaves the Authorization header
+// to the service behind IAP.
+// see: https://cloud.google.com/iap/docs/authentication-howto#authenticating_from_proxy-authorization_header
+const DefaultHeader = "Proxy-Authorization"
+
+// GeneratedResponseHeader is set by IAP on the responses it makes itself, rather than the service behind it.
+const GeneratedResponseHeader = "X-Goog-IAP-Generated-Response"
+
+// MaxReplayBody is the size of the largest request body callers should keep in memory, so that their request
+// can be replayed by Transport when IAP bounces it. Larger bodies, such as push packs or LFS uploads,
+// are better streamed, and their requests are not retried.
+const MaxReplayBody = 1 << 20
+
+// An Invalidator is a source of tokens that can drop a token refused by IAP, like TokenSource.
+type Invalidator interface {
+	Invalidate(token *oauth2.Token)
+}
+
+// A Transport is an http.RoundTripper that injects an IAP ID token in every request.
+// When Source is an Invalidator, tokens refused by IAP are dropped, and the requests are retried
+// once with a new token if their body can be replayed.
+type Transport struct {
+	// Source supplies the ID tokens, usually a TokenSource.
+	Source oauth2.TokenSource
+
+	// Base is the RoundTripper used to make requests. It defaults to http.DefaultTransport.
+	Base http.RoundTripper
+
+	// Header is the header carrying the ID token. It defaults to DefaultHeader.
+	Header string
+}
+
+// NewClient returns an http.Client authenticating its requests with the ID tokens of ts.
+// Redirects are not followed, so that they do not leak ID tokens to other hosts.
+func NewClient(ts oauth2.TokenSource) *http.Client {
+	return &http.Client{
+		Transport: &Transport{Source: ts},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	header := t.Header
+	if header == "" {
+		header = DefaultHeader
+	}
+	invalidator, canRetry := t.Source.(Invalidator)
+
+	for attempt := 1; ; attempt++ {
+		token, err := t.Source.Token()
+		if err != nil {
+			// RoundTrip must close the body, even on errors; on retries, base already did
+			if attempt == 1 && r.Body != nil {
+				r.Body.Close()
+			}
+			return nil, fmt.Errorf("[Transport] Could not get IAP ID token: %w", err)
+		}
+
+		out := r.Clone(r.Context())
+		if attempt > 1 && r.GetBody != nil {
+			if out.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		out.Header.Set(header, fmt.Sprintf("Bearer %s", token.AccessToken))
+
+		resp, err := base.RoundTrip(out)
+		if err != nil {
+			return nil, err
+		}
+		if attempt > 1 || !canRetry || !IsIAPBounce(resp) {
+			return resp, nil
+		}
+
+		invalidator.Invalidate(token)
+		if r.Body != nil && r.GetBody == nil {
+			// the body is gone, but the next requests get a new token
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// IsIAPBounce reports whether IAP refused the token of a request, either by redirecting
+// to the Google sign-in page or by answering with 401 itself. A 401 of the service behind IAP is not a bounce.
+func IsIAPBounce(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return resp.Header.Get(GeneratedResponseHeader) != ""
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+		loc, err := resp.Location()
+		return err == nil && loc.Host == "accounts.google.com"
+	}
+	return false
+}
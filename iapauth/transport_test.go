@@ -0,0 +1,176 @@
+package iapauth
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iaptest"
+	"golang.org/x/oauth2"
+)
+
+// newIAPStandIn returns a server that only accepts "token-2" in header, and bounces other requests
+// to the Google sign-in page, like IAP. It answers with the body of the requests.
+func newIAPStandIn(t *testing.T, header string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(header) != "Bearer token-2" {
+			http.Redirect(w, r, "https://accounts.google.com/o/oauth2/v2/auth", http.StatusFound)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTransportRetry(t *testing.T) {
+	srv := newIAPStandIn(t, DefaultHeader)
+	source := &iaptest.RotatingSource{}
+
+	resp, err := NewClient(source).Post(srv.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(body) != "body" {
+		t.Errorf("got HTTP %d %q, want the request to be retried with its body", resp.StatusCode, body)
+	}
+	if source.Invalidated() != 1 {
+		t.Errorf("the refused token was invalidated %d times, want 1", source.Invalidated())
+	}
+}
+
+func TestTransportNoRetry(t *testing.T) {
+	srv := newIAPStandIn(t, DefaultHeader)
+
+	// the body cannot be replayed
+	source := &iaptest.RotatingSource{}
+	resp, err := NewClient(source).Post(srv.URL, "text/plain", ioutil.NopCloser(strings.NewReader("body")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !IsIAPBounce(resp) || source.Invalidated() != 1 {
+		t.Errorf("got HTTP %d, invalidated %d times, want the bounce and the token invalidated", resp.StatusCode, source.Invalidated())
+	}
+
+	// the source cannot drop tokens
+	resp, err = NewClient(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token-1"})).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !IsIAPBounce(resp) {
+		t.Errorf("got HTTP %d, want the bounce", resp.StatusCode)
+	}
+
+	// the token is refused twice
+	source = &iaptest.RotatingSource{}
+	client := &http.Client{
+		Transport:     &Transport{Source: source, Header: "X-Other"},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err = client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !IsIAPBounce(resp) || source.Invalidated() != 1 {
+		t.Errorf("got HTTP %d, invalidated %d times, want a single retry", resp.StatusCode, source.Invalidated())
+	}
+}
+
+func TestTransportHeader(t *testing.T) {
+	for _, header := range []string{"", "Authorization"} {
+		want := header
+		if want == "" {
+			want = DefaultHeader
+		}
+		var got http.Header
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header
+		}))
+
+		client := &http.Client{Transport: &Transport{Source: &iaptest.RotatingSource{}, Header: header}}
+		resp, err := client.Get(srv.URL)
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if got.Get(want) != "Bearer token-1" {
+			t.Errorf("Header %q: the token was not sent in %s", header, want)
+		}
+		for _, other := range []string{DefaultHeader, "Authorization"} {
+			if other != want && got.Get(other) != "" {
+				t.Errorf("Header %q: the token was also sent in %s", header, other)
+			}
+		}
+	}
+}
+
+// failingSource cannot get tokens.
+type failingSource struct{}
+
+func (failingSource) Token() (*oauth2.Token, error) {
+	return nil, errors.New("no refresh token")
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTransportClosesBodyOnError(t *testing.T) {
+	body := &closeRecorder{Reader: strings.NewReader("body")}
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:1", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Transport{Source: failingSource{}}).RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip should fail without a token")
+	}
+	if !body.closed {
+		t.Error("RoundTrip did not close the body of the request")
+	}
+}
+
+func TestIsIAPBounce(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		location  string
+		generated bool
+		want      bool
+	}{
+		{http.StatusUnauthorized, "", true, true},
+		{http.StatusUnauthorized, "", false, false},
+		{http.StatusFound, "https://accounts.google.com/o/oauth2/v2/auth", false, true},
+		{http.StatusFound, "https://git.domain.acme/repo.git/", false, false},
+		{http.StatusOK, "", false, false},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+		if tc.location != "" {
+			resp.Header.Set("Location", tc.location)
+		}
+		if tc.generated {
+			resp.Header.Set(GeneratedResponseHeader, "true")
+		}
+		if got := IsIAPBounce(resp); got != tc.want {
+			t.Errorf("IsIAPBounce(%d %s, generated by IAP: %v) = %v, want %v", tc.status, tc.location, tc.generated, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+	"github.com/adohkan/git-remote-https-iap/internal/proxy"
+)
+
+// An Agent holds IAP auth tokens in memory, refreshes them ahead of their expiry,
+// and serves them to processes of the same user over a Unix socket.
+type Agent struct {
+	mu      sync.Mutex
+	sources map[string]*proxy.TokenSource
+	stop    chan struct{}
+}
+
+// New returns an Agent with no token.
+func New() *Agent {
+	return &Agent{
+		sources: map[string]*proxy.TokenSource{},
+		stop:    make(chan struct{}),
+	}
+}
+
+// Listen creates the socket of the agent, only accessible by the current user.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket left at path by an agent that is gone.
+// It refuses to remove the socket of a running agent, or anything that is not a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("an agent is already listening on %s", path)
+	}
+	return os.Remove(path)
+}
+
+// Serve accepts connections on l until it is closed.
+func (a *Agent) Serve(l net.Listener) error {
+	defer close(a.stop)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if err := checkPeer(conn); err != nil {
+			log.Warn().Msgf("[Agent] Refused connection: %s", err)
+			conn.Close()
+			continue
+		}
+		go a.serveConn(conn)
+	}
+}
+
+func (a *Agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	enc := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req Request
+		resp := Response{Version: ProtocolVersion}
+
+		switch err := json.Unmarshal(scanner.Bytes(), &req); {
+		case err != nil:
+			resp.Error = fmt.Sprintf("invalid request: %s", err)
+		case req.Version != ProtocolVersion:
+			resp.Error = fmt.Sprintf("unsupported protocol version %d, expected %d", req.Version, ProtocolVersion)
+		case req.Method != MethodToken:
+			resp.Error = fmt.Sprintf("unknown method '%s'", req.Method)
+		default:
+			if c, err := a.token(req.URL); err != nil {
+				resp.Error = err.Error()
+			} else {
+				resp.Token, resp.ExpiresAt = c.Token.Raw, c.Claims.ExpiresAt
+			}
+		}
+
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// token returns a valid IAP Cookie for a URL. URLs sharing the same audience and account share the same token.
+// The git config of the URL is read on each request, so that changes to its clientID or account, or its removal,
+// apply without restarting the agent.
+func (a *Agent) token(url string) (*iap.Cookie, error) {
+	if err := iap.CheckConfig(url); err != nil {
+		return nil, err
+	}
+	key, err := iap.TokenKey(url)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	source, ok := a.sources[key]
+	if !ok {
+		log.Debug().Msgf("[Agent] New token source for %s (%s)", url, key)
+		source = proxy.NewTokenSource(url, nil)
+		a.sources[key] = source
+		go source.KeepFresh(a.stop)
+	}
+	a.mu.Unlock()
+
+	return source.Cookie()
+}
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/adohkan/git-remote-https-iap/internal/proxy"
+	jwt "github.com/golang-jwt/jwt"
+)
+
+func TestListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(path); err == nil {
+		t.Error("Listen should refuse the socket of a running agent")
+	}
+
+	// the socket of a stopped agent is replaced
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = Listen(path)
+	if err != nil {
+		t.Fatalf("Listen on a stale socket: %s", err)
+	}
+	l.Close()
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(file); err == nil {
+		t.Error("Listen should refuse to replace a file which is not a socket")
+	}
+}
+
+// newIDToken returns a new ID token for an audience, expiring after d. Its signature is not valid.
+func newIDToken(t *testing.T, audience string, d time.Duration) string {
+	t.Helper()
+	raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Audience:  audience,
+		ExpiresAt: time.Now().Add(d).Unix(),
+	}).SignedString([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// newTestAgent serves an Agent on a socket in a temporary directory, with IAP configured for each URL
+// with its client ID in an empty global git config. The agent already holds a token for client-a.
+func newTestAgent(t *testing.T, clientIDs map[string]string) (*Agent, string, string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	for url, clientID := range clientIDs {
+		for _, c := range [][2]string{
+			{"iap." + url + ".helperID", "helper-id"},
+			{"iap." + url + ".helperSecret", "helper-secret"},
+			{"iap." + url + ".clientID", clientID},
+			{"http." + url + ".cookieFile", filepath.Join(home, "cookie")},
+		} {
+			if out, err := exec.Command("git", "config", "--global", c[0], c[1]).CombinedOutput(); err != nil {
+				t.Fatalf("git config %s: %s\n%s", c[0], err, out)
+			}
+		}
+	}
+
+	raw := newIDToken(t, "client-a", time.Hour)
+	cookie, err := iap.CookieFromToken("https://a.example.com", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := New()
+	a.sources["client-a/"+iap.DefaultAccount] = proxy.NewTokenSource("https://a.example.com", cookie)
+
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Serve(l)
+	t.Cleanup(func() { l.Close() })
+	t.Setenv(SockEnvVariable, path)
+	return a, path, raw
+}
+
+func TestAgentToken(t *testing.T) {
+	a, _, raw := newTestAgent(t, map[string]string{
+		"https://a.example.com": "client-a",
+		"https://b.example.com": "client-a",
+	})
+
+	for _, url := range []string{"https://a.example.com/repo.git", "https://b.example.com/repo.git"} {
+		token, exp, err := Token(url)
+		if err != nil {
+			t.Fatalf("Token(%s): %s", url, err)
+		}
+		if token != raw {
+			t.Errorf("Token(%s) = %q, want the token of the audience", url, token)
+		}
+		if exp < time.Now().Unix() {
+			t.Errorf("Token(%s) expires at %d, in the past", url, exp)
+		}
+	}
+	a.mu.Lock()
+	sources := len(a.sources)
+	a.mu.Unlock()
+	if sources != 1 {
+		t.Errorf("the agent has %d token sources, want 1 shared by the audience", sources)
+	}
+
+	if _, _, err := Token("https://c.example.com/repo.git"); err == nil || !strings.Contains(err.Error(), "not configured for IAP") {
+		t.Errorf("got %v, want an error for a URL that is not configured for IAP", err)
+	}
+
+	// the config is read again on each request
+	if out, err := exec.Command("git", "config", "--global", "--unset", "iap.https://b.example.com.clientID").CombinedOutput(); err != nil {
+		t.Fatalf("git config: %s\n%s", err, out)
+	}
+	if _, _, err := Token("https://b.example.com/repo.git"); err == nil || !strings.Contains(err.Error(), "not configured for IAP") {
+		t.Errorf("got %v, want an error for a URL that is no longer configured for IAP", err)
+	}
+}
+
+func TestAgentProtocol(t *testing.T) {
+	_, path, raw := newTestAgent(t, map[string]string{"https://a.example.com": "client-a"})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(RequestTimeout))
+	r := bufio.NewReader(conn)
+
+	// requests are answered in order over the same connection
+	for _, tc := range []struct {
+		request   string
+		wantToken string
+		wantError string
+	}{
+		{fmt.Sprintf(`{"version":%d,"method":"token","url":"https://a.example.com/repo.git"}`, ProtocolVersion), raw, ""},
+		{`{"version":99,"method":"token","url":"https://a.example.com/repo.git"}`, "", "unsupported protocol version 99"},
+		{fmt.Sprintf(`{"version":%d,"method":"revoke","url":"https://a.example.com/repo.git"}`, ProtocolVersion), "", "unknown method 'revoke'"},
+		{`not json`, "", "invalid request"},
+	} {
+		if _, err := fmt.Fprintln(conn, tc.request); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Version != ProtocolVersion {
+			t.Errorf("%s: got version %d, want %d", tc.request, resp.Version, ProtocolVersion)
+		}
+		if resp.Token != tc.wantToken {
+			t.Errorf("%s: got token %q, want %q", tc.request, resp.Token, tc.wantToken)
+		}
+		if !strings.Contains(resp.Error, tc.wantError) || (tc.wantError == "") != (resp.Error == "") {
+			t.Errorf("%s: got error %q, want %q", tc.request, resp.Error, tc.wantError)
+		}
+	}
+}
+
+func TestTokenWithoutAgent(t *testing.T) {
+	t.Setenv(SockEnvVariable, "")
+	if _, _, err := Token("https://a.example.com"); err == nil {
+		t.Error("Token should fail when no agent is set")
+	}
+
+	t.Setenv(SockEnvVariable, filepath.Join(t.TempDir(), "missing.sock"))
+	if _, _, err := Token("https://a.example.com"); err == nil {
+		t.Error("Token should fail when the agent is gone")
+	}
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Token asks the agent listening on GIT_IAP_AGENT_SOCK for a valid IAP auth token for a URL.
+// It returns the raw token and its expiry.
+func Token(url string) (string, int64, error) {
+	path := os.Getenv(SockEnvVariable)
+	if path == "" {
+		return "", 0, errors.New("no agent: " + SockEnvVariable + " is not set")
+	}
+	if err := checkSocket(path); err != nil {
+		return "", 0, err
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+	// the agent may be waiting for a browser login, callers then go on without it
+	if err := conn.SetDeadline(time.Now().Add(RequestTimeout)); err != nil {
+		return "", 0, err
+	}
+
+	if err := json.NewEncoder(conn).Encode(Request{Version: ProtocolVersion, Method: MethodToken, URL: url}); err != nil {
+		return "", 0, err
+	}
+
+	var resp Response
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return "", 0, err
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return "", 0, err
+	}
+	if resp.Error != "" {
+		return "", 0, fmt.Errorf("agent: %s", resp.Error)
+	}
+	return resp.Token, resp.ExpiresAt, nil
+}
@@ -0,0 +1,51 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// checkSocket refuses sockets that are not owned by the current user.
+func checkSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("agent socket %s is owned by uid %d, not %d", path, st.Uid, os.Getuid())
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("agent socket %s is accessible by other users (%#o)", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// checkPeer refuses connections from other users.
+func checkPeer(conn net.Conn) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("unexpected connection type %T", conn)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var uid int
+	var credErr error
+	if err := raw.Control(func(fd uintptr) { uid, credErr = peerUID(int(fd)) }); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return credErr
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("peer uid %d is not %d", uid, os.Getuid())
+	}
+	return nil
+}
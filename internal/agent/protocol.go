@@ -0,0 +1,33 @@
+package agent
+
+import "time"
+
+const (
+	// SockEnvVariable is the name of the environment variable holding the path of the agent's socket
+	SockEnvVariable = "GIT_IAP_AGENT_SOCK"
+
+	// ProtocolVersion is the version of the protocol spoken over the agent's socket.
+	// Requests and responses are JSON documents, one per line.
+	ProtocolVersion = 1
+
+	// MethodToken asks for a valid IAP auth token for a URL
+	MethodToken = "token"
+
+	// RequestTimeout is how long clients wait for the answer of the agent.
+	RequestTimeout = 30 * time.Second
+)
+
+// A Request is sent by clients of the agent.
+type Request struct {
+	Version int    `json:"version"`
+	Method  string `json:"method"`
+	URL     string `json:"url"`
+}
+
+// A Response is sent by the agent for each Request.
+type Response struct {
+	Version   int    `json:"version"`
+	Token     string `json:"token,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
@@ -1,15 +1,21 @@
 package git
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	_url "net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/rs/zerolog/log"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
 )
 
 const (
@@ -17,30 +23,168 @@ const (
 	GitBinary = "git"
 )
 
+// Scopes of git config, as in 'git config --<scope>'. Entries of ScopeFile are written to a file of
+// the user's choice, and entries of ScopeIncludeIf to a profile file, included by the global config
+// for the repositories under a directory only.
+const (
+	ScopeGlobal    = "global"
+	ScopeSystem    = "system"
+	ScopeLocal     = "local"
+	ScopeFile      = "file"
+	ScopeIncludeIf = "includeIf"
+)
+
+// A ConfigScope tells where git config entries are written. The zero value is ScopeGlobal.
+type ConfigScope struct {
+	Kind string
+	// File is the config file of ScopeFile and ScopeIncludeIf
+	File string
+	// GitDir is the condition of ScopeIncludeIf, as in [includeIf "gitdir:<GitDir>"]
+	GitDir string
+}
+
+// ParseConfigScope parses the scopes given on the command line: global, system, local,
+// file:<path> or includeIf:<gitdir>. The File of includeIf scopes is left to the caller.
+func ParseConfigScope(s string) (ConfigScope, error) {
+	kind, arg := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, arg = s[:i], s[i+1:]
+	}
+
+	switch kind {
+	case "", ScopeGlobal, ScopeSystem, ScopeLocal:
+		if arg != "" {
+			return ConfigScope{}, fmt.Errorf("ParseConfigScope - scope '%s' takes no argument", kind)
+		}
+		return ConfigScope{Kind: kind}, nil
+	case ScopeFile:
+		if arg == "" {
+			return ConfigScope{}, fmt.Errorf("ParseConfigScope - missing path, as in file:<path>")
+		}
+		return ConfigScope{Kind: ScopeFile, File: expandHome(arg)}, nil
+	case ScopeIncludeIf:
+		if arg == "" {
+			return ConfigScope{}, fmt.Errorf("ParseConfigScope - missing directory, as in includeIf:~/work/clientX/")
+		}
+		// like git, match everything under the directory
+		if !strings.HasSuffix(arg, "/") {
+			arg += "/"
+		}
+		return ConfigScope{Kind: ScopeIncludeIf, GitDir: arg}, nil
+	}
+	return ConfigScope{}, fmt.Errorf("ParseConfigScope - unknown scope '%s', expected global, system, local, file:<path> or includeIf:<gitdir>", s)
+}
+
+// Args returns the options of 'git config' selecting the scope.
+func (s ConfigScope) Args() []string {
+	switch s.Kind {
+	case ScopeSystem, ScopeLocal:
+		return []string{"--" + s.Kind}
+	case ScopeFile, ScopeIncludeIf:
+		return []string{"--file", s.File}
+	}
+	return []string{"--global"}
+}
+
+// Include returns the global config entry including the profile file of a ScopeIncludeIf,
+// or nil for other scopes.
+func (s ConfigScope) Include() *GitConfig {
+	if s.Kind != ScopeIncludeIf {
+		return nil
+	}
+	return &GitConfig{Url: "gitdir:" + s.GitDir, Section: "includeIf", Key: "path", Value: s.File}
+}
+
+func (s ConfigScope) String() string {
+	switch s.Kind {
+	case "":
+		return ScopeGlobal
+	case ScopeFile:
+		return fmt.Sprintf("file:%s", s.File)
+	case ScopeIncludeIf:
+		return fmt.Sprintf("includeIf:%s (%s)", s.GitDir, s.File)
+	}
+	return s.Kind
+}
+
 type GitConfig struct {
 	Url     string
 	Section string
 	Key     string
 	Value   string
+	Scope   ConfigScope
 }
 
 func (c *GitConfig) Name() string {
+	if c.Url == "" {
+		return fmt.Sprintf("%s.%s", c.Section, c.Key)
+	}
 	return fmt.Sprintf("%s.%s.%s", c.Section, c.Url, c.Key)
 }
 
-func (c *GitConfig) ArgsGlobal() []string {
-	return []string{"config", "--global", c.Name(), c.Value}
+// Args returns the arguments of 'git config' writing the entry in its scope.
+func (c *GitConfig) Args() []string {
+	args := append([]string{"config"}, c.Scope.Args()...)
+	return append(args, c.Name(), c.Value)
+}
+
+func (c *GitConfig) CommandSuggest() string {
+	return fmt.Sprintf("git %s", strings.Join(c.Args(), " "))
 }
 
-func (c *GitConfig) CommandSuggestGlobal() string {
-	return fmt.Sprintf("git %s", strings.Join(c.ArgsGlobal(), " "))
+// A ConfigOrigin tells where a config value was read from, as in 'git config --show-scope --show-origin'.
+type ConfigOrigin struct {
+	// Scope is one of system, global, local, worktree or command
+	Scope string
+	// File is empty for values given on the command line or in the environment
+	File string
+}
+
+func (o *ConfigOrigin) String() string {
+	if o.File == "" {
+		return o.Scope
+	}
+	return fmt.Sprintf("%s (%s)", o.Scope, o.File)
+}
+
+// matchingURL returns a URL that the config of url applies to, as 'git config --get-urlmatch' refuses
+// the wildcard hosts allowed in the names of config entries.
+func matchingURL(url string) string {
+	return strings.Replace(url, "*", "wildcard", -1)
+}
+
+// MatchURL reports whether the config of a URL-scoped entry, such as the https://*.example.com/group of
+// iap.https://*.example.com/group.clientID, applies to url, as in 'git config --get-urlmatch': the scheme
+// and port must be equal, '*' in the host stands for one label, and the path is a prefix of whole segments.
+func MatchURL(pattern, url string) bool {
+	p, err := _url.Parse(pattern)
+	if err != nil {
+		return false
+	}
+	u, err := _url.Parse(url)
+	if err != nil || !strings.EqualFold(p.Scheme, u.Scheme) || p.Port() != u.Port() {
+		return false
+	}
+
+	patterns, labels := strings.Split(p.Hostname(), "."), strings.Split(u.Hostname(), ".")
+	if len(patterns) != len(labels) {
+		return false
+	}
+	for i, label := range patterns {
+		if label != "*" && !strings.EqualFold(label, labels[i]) {
+			return false
+		}
+	}
+
+	prefix := strings.TrimSuffix(p.Path, "/")
+	return u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/")
 }
 
 // ConfigGetURLMatch call 'git config --get-urlmatch' underneath
 func ConfigGetURLMatch(key, url string) string {
 	var stdout bytes.Buffer
 
-	args := []string{"config", "--get-urlmatch", key, url}
+	args := []string{"config", "--get-urlmatch", key, matchingURL(url)}
 	cmd := exec.Command(GitBinary, args...)
 	cmd.Stdout = &stdout
 
@@ -48,15 +192,338 @@ func ConfigGetURLMatch(key, url string) string {
 		log.Fatal().Msgf("ConfigGetURLMatch - could not read config '%s' for '%s' (%s)", key, url, err)
 	}
 
-	return strings.TrimSpace(string(stdout.Bytes()))
+	value := strings.TrimSpace(string(stdout.Bytes()))
+	logOrigin(key, url, value)
+	return value
 }
 
-// SetConfigGlobal is a new signature for SetGlobalConfig
-func SetConfigGlobal(config *GitConfig) {
-	cmd := exec.Command(GitBinary, config.ArgsGlobal()...)
+// ConfigLookupURLMatch is similar to ConfigGetURLMatch, but reports whether the key
+// is set instead of exiting when it is missing.
+func ConfigLookupURLMatch(key, url string) (string, bool) {
+	value, ok, err := ConfigURLMatch(key, url)
+	if err != nil {
+		log.Fatal().Msgf("ConfigLookupURLMatch - %s", err)
+	}
+	return value, ok
+}
+
+// ConfigURLMatch is similar to ConfigLookupURLMatch, but returns an error instead of exiting
+// when the config cannot be read, for the code running in other programs.
+func ConfigURLMatch(key, url string) (string, bool, error) {
+	var stdout bytes.Buffer
+
+	args := []string{"config", "--get-urlmatch", key, matchingURL(url)}
+	cmd := exec.Command(GitBinary, args...)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return "", false, fmt.Errorf("could not read config '%s' for '%s' (%s)", key, url, err)
+		}
+		return "", false, nil
+	}
+
+	value := strings.TrimSpace(string(stdout.Bytes()))
+	logOrigin(key, url, value)
+	return value, true, nil
+}
+
+// ConfigOriginURLMatch is similar to ConfigURLMatch, but also reports the scope and file the value comes from.
+func ConfigOriginURLMatch(key, url string) (string, *ConfigOrigin, bool, error) {
+	value, ok, err := ConfigURLMatch(key, url)
+	if err != nil || !ok {
+		return "", nil, false, err
+	}
+	return value, configOrigin(key, url, value), true, nil
+}
+
+// logOrigin logs where a value read with 'git config --get-urlmatch' comes from, when debug logs are enabled.
+func logOrigin(key, url, value string) {
+	if e := log.Debug(); e.Enabled() {
+		e.Msgf("[git.Config] %s for %s read from %s", key, url, configOrigin(key, url, value))
+	}
+}
+
+// configOrigin finds where the value of key for url comes from, as 'git config' does not show the origin
+// of --get-urlmatch: every file defining the key is asked for the value it has for url, and the last one
+// agreeing with the actual value, in order of precedence, is its origin.
+func configOrigin(key, url, value string) *ConfigOrigin {
+	var stdout bytes.Buffer
+
+	dot := strings.Index(key, ".")
+	if dot < 0 {
+		return &ConfigOrigin{Scope: "unknown"}
+	}
+	pattern := fmt.Sprintf(`^%s(\..*)?\.%s$`, regexp.QuoteMeta(key[:dot]), regexp.QuoteMeta(key[dot+1:]))
+	cmd := exec.Command(GitBinary, "config", "--null", "--show-scope", "--show-origin", "--get-regexp", pattern)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return &ConfigOrigin{Scope: "unknown"}
+	}
+
+	// --null output: <scope>\0<origin>\0<name>\n<value>\0
+	fields := strings.Split(stdout.String(), "\x00")
+	origin := &ConfigOrigin{Scope: "unknown"}
+	seen := map[string]bool{}
+	for i := 0; i+2 < len(fields); i += 3 {
+		candidate := &ConfigOrigin{Scope: fields[i]}
+		if file := strings.TrimPrefix(fields[i+1], "file:"); file != fields[i+1] {
+			candidate.File = file
+		}
+
+		if candidate.File == "" {
+			if strings.HasSuffix(fields[i+2], "\n"+value) {
+				origin = candidate
+			}
+			continue
+		}
+		if seen[candidate.File] {
+			continue
+		}
+		seen[candidate.File] = true
+
+		var v bytes.Buffer
+		cmd := exec.Command(GitBinary, "config", "--file", candidate.File, "--get-urlmatch", key, matchingURL(url))
+		cmd.Stdout = &v
+		if cmd.Run() == nil && strings.TrimSpace(v.String()) == value {
+			origin = candidate
+		}
+	}
+	return origin
+}
+
+// ConfigLookup reads a config entry with 'git config --get', and reports whether it is set.
+func ConfigLookup(name string) (string, bool) {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "config", "--get", name)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			log.Fatal().Msgf("ConfigLookup - could not read config '%s' (%s)", name, err)
+		}
+		return "", false
+	}
+	return strings.TrimSpace(stdout.String()), true
+}
+
+// RewriteURL returns the URL git uses for a remote URL, once 'url.<base>.insteadOf' rules are applied.
+func RewriteURL(url string) (string, error) {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "ls-remote", "--get-url", url)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("RewriteURL - could not resolve '%s': %w", url, err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Version returns the version of the git client, as in 'git version 2.39.5'.
+func Version() (string, error) {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "version")
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Version - could not run %s: %w", GitBinary, err)
+	}
+	return strings.TrimPrefix(strings.TrimSpace(stdout.String()), "git version "), nil
+}
+
+// VersionAtLeast reports whether a version returned by Version is at least major.minor.
+func VersionAtLeast(version string, major, minor int) bool {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	maj, err1 := strconv.Atoi(parts[0])
+	min, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return maj > major || (maj == major && min >= minor)
+}
+
+// ConfigGetURLMatchBool reads a boolean config for a given URL, which defaults to false when missing.
+func ConfigGetURLMatchBool(key, url string) bool {
+	var stdout bytes.Buffer
+
+	args := []string{"config", "--type=bool", "--get-urlmatch", key, matchingURL(url)}
+	cmd := exec.Command(GitBinary, args...)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			log.Fatal().Msgf("ConfigGetURLMatchBool - could not read config '%s' for '%s' (%s)", key, url, err)
+		}
+		return false
+	}
+
+	return strings.TrimSpace(stdout.String()) == "true"
+}
+
+// ConfigGetRegexpGlobal call 'git config --global --get-regexp' underneath,
+// and returns every URL-scoped entry (<section>.<url>.<key>) whose name matches the pattern.
+func ConfigGetRegexpGlobal(pattern string) []*GitConfig {
+	return ConfigGetRegexpIn(ConfigScope{Kind: ScopeGlobal}, pattern)
+}
+
+// ConfigGetRegexpIn is similar to ConfigGetRegexpGlobal, for the config file of a given scope.
+// Returned entries have that scope.
+func ConfigGetRegexpIn(scope ConfigScope, pattern string) []*GitConfig {
+	configs := configGetRegexp(append(scope.Args(), "--get-regexp", pattern))
+	for _, c := range configs {
+		c.Scope = scope
+	}
+	return configs
+}
+
+// ConfigGetRegexp is similar to ConfigGetRegexpGlobal, for the config git sees from the current directory,
+// with every scope and include. Returned entries have no scope.
+func ConfigGetRegexp(pattern string) []*GitConfig {
+	return configGetRegexp([]string{"--get-regexp", pattern})
+}
+
+func configGetRegexp(options []string) []*GitConfig {
+	var stdout bytes.Buffer
+
+	args := append([]string{"config"}, options...)
+	cmd := exec.Command(GitBinary, args...)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			log.Fatal().Msgf("ConfigGetRegexp - could not read config with %v (%s)", options, err)
+		}
+		return nil
+	}
+
+	var configs []*GitConfig
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		name, value := fields[0], ""
+		if len(fields) == 2 {
+			value = fields[1]
+		}
+		first, last := strings.Index(name, "."), strings.LastIndex(name, ".")
+		if first == last {
+			continue
+		}
+		configs = append(configs, &GitConfig{
+			Url:     name[first+1 : last],
+			Section: name[:first],
+			Key:     name[last+1:],
+			Value:   value,
+		})
+	}
+	return configs
+}
+
+// ConfigNamesIn returns the names of every entry in the config file of a given scope, including the ones
+// without URL that ConfigGetRegexpIn leaves out.
+func ConfigNamesIn(scope ConfigScope) []string {
+	var stdout bytes.Buffer
+
+	// git fails to list a file that does not exist, which has no entry
+	if scope.File != "" {
+		if _, err := os.Stat(scope.File); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	cmd := exec.Command(GitBinary, append(append([]string{"config"}, scope.Args()...), "--list", "--name-only")...)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		log.Fatal().Msgf("ConfigNamesIn - could not list config in %s (%s)", scope, err)
+	}
+	return strings.Fields(stdout.String())
+}
+
+// ConfigGetIn reads an entry from the config file of a given scope, and reports whether it is set.
+// The Url, Section and Key of config select the entry, its Value is filled in.
+func ConfigGetIn(config *GitConfig) bool {
+	var stdout bytes.Buffer
+
+	args := append(append([]string{"config"}, config.Scope.Args()...), "--get", config.Name())
+	cmd := exec.Command(GitBinary, args...)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			log.Fatal().Msgf("ConfigGetIn - could not read config '%s' in %s (%s)", config.Name(), config.Scope, err)
+		}
+		return false
+	}
+	config.Value = strings.TrimSpace(stdout.String())
+	return true
+}
+
+// UnsetConfig removes an entry from the config file of its scope, along with its section when nothing is left in it.
+// The application exits in case of error.
+func UnsetConfig(config *GitConfig) {
+	args := append(append([]string{"config"}, config.Scope.Args()...), "--unset-all", config.Name())
+	if config.Value != "" {
+		args = append(args, "^"+regexp.QuoteMeta(config.Value)+"$")
+	}
+	cmd := exec.Command(GitBinary, args...)
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		// 5: the entry is not set
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 5 {
+			log.Fatal().Msgf("UnsetConfig - could not unset config '%s' in %s: %s", config.Name(), config.Scope, err)
+		}
+	}
+
+	section := fmt.Sprintf("%s.%s", strings.ToLower(config.Section), config.Url)
+	if len(configGetRegexp(append(config.Scope.Args(), "--get-regexp", "^"+regexp.QuoteMeta(section)+"\\."))) > 0 {
+		return
+	}
+	cmd = exec.Command(GitBinary, append(append([]string{"config"}, config.Scope.Args()...), "--remove-section", section)...)
+	if err := cmd.Run(); err != nil {
+		log.Debug().Msgf("UnsetConfig - could not remove section '%s' in %s: %s", section, config.Scope, err)
+	}
+}
+
+// SetConfig writes a config entry in its scope. The profile file of a ScopeIncludeIf is included
+// by the global config, if it is not already.
+// The application exits in case of error.
+func SetConfig(config *GitConfig) {
+	if err := WriteConfig(config); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+}
+
+// WriteConfig is similar to SetConfig, but returns an error instead of exiting.
+func WriteConfig(config *GitConfig) error {
+	if config.Scope.File != "" {
+		if err := os.MkdirAll(filepath.Dir(config.Scope.File), 0o700); err != nil {
+			return fmt.Errorf("SetConfig - could not create the directory of %s: %w", config.Scope.File, err)
+		}
+	}
+	if include := config.Scope.Include(); include != nil {
+		if err := addConfigGlobal(include); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command(GitBinary, config.Args()...)
 	if err := cmd.Run(); err != nil {
-		log.Fatal().Msgf("SetGlobalConfig - could not set config '%s': %s", config.Name(), err)
+		return fmt.Errorf("SetConfig - could not set config '%s' in %s: %w", config.Name(), config.Scope, err)
 	}
+	return nil
+}
+
+// SetConfigGlobal is a new signature for SetGlobalConfig
+func SetConfigGlobal(config *GitConfig) {
+	global := *config
+	global.Scope = ConfigScope{Kind: ScopeGlobal}
+	SetConfig(&global)
 }
 
 // SetGlobalConfig allows to set system-wide Git configuration.
@@ -70,6 +537,97 @@ func SetGlobalConfig(url, section, key, value string) {
 	})
 }
 
+// ReplaceConfig replaces the values of a config entry that are equal to old with config.Value,
+// in the config file of its scope. Other values of a multi-valued entry are kept.
+// The application exits in case of error.
+func ReplaceConfig(config *GitConfig, old string) {
+	args := append(append([]string{"config"}, config.Scope.Args()...), "--replace-all", config.Name(), config.Value, "^"+regexp.QuoteMeta(old)+"$")
+	cmd := exec.Command(GitBinary, args...)
+	if err := cmd.Run(); err != nil {
+		log.Fatal().Msgf("ReplaceConfig - could not replace config '%s' in %s: %s", config.Name(), config.Scope, err)
+	}
+}
+
+// GitDir returns the absolute path of the git directory of the repository in dir,
+// which is not dir/.git for submodules and worktrees.
+func GitDir(dir string) (string, error) {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "-C", dir, "rev-parse", "--absolute-git-dir")
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("GitDir - %s is not a git repository: %w", dir, err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// CurrentBranch returns the short name of the branch checked out in dir, and an error when HEAD is detached.
+func CurrentBranch(dir string) (string, error) {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "-C", dir, "symbolic-ref", "--quiet", "--short", "HEAD")
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("CurrentBranch - no branch checked out in %s: %w", dir, err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// addConfigGlobal adds a value to a multi-valued key of the global config, unless it is already there.
+func addConfigGlobal(config *GitConfig) error {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "config", "--global", "--get-all", config.Name())
+	cmd.Stdout = &stdout
+	_ = cmd.Run()
+	for _, v := range strings.Split(stdout.String(), "\n") {
+		if v == config.Value {
+			return nil
+		}
+	}
+
+	cmd = exec.Command(GitBinary, "config", "--global", "--add", config.Name(), config.Value)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("SetConfig - could not add config '%s': %w", config.Name(), err)
+	}
+	return nil
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// ConfigEnv returns a copy of environ that adds configs to any git command run with it,
+// using GIT_CONFIG_COUNT, GIT_CONFIG_KEY_<n> and GIT_CONFIG_VALUE_<n> (git >= 2.31).
+// Entries already present in environ are kept.
+func ConfigEnv(environ []string, configs ...*GitConfig) []string {
+	count := 0
+	env := make([]string, 0, len(environ)+2*len(configs)+1)
+	for _, e := range environ {
+		if strings.HasPrefix(e, "GIT_CONFIG_COUNT=") {
+			count, _ = strconv.Atoi(strings.TrimPrefix(e, "GIT_CONFIG_COUNT="))
+			continue
+		}
+		env = append(env, e)
+	}
+
+	for _, c := range configs {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count, c.Name()),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, c.Value),
+		)
+		count++
+	}
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", count))
+}
+
 // PassThruRemoteHTTPSHelper exec the git-remote-https helper,
 // which allows the caller to transparently pass-thru it.
 func PassThruRemoteHTTPSHelper(remote, url string, token string) {
@@ -80,7 +638,47 @@ func PassThruRemoteHTTPSHelper(remote, url string, token string) {
 	u.Scheme = "https"
 	extraHeader := fmt.Sprintf("http.extraHeader=Proxy-Authorization: Bearer %s", token)
 
-	args := []string{"git", "-c", extraHeader, "remote-https", remote, u.String()}
+	runRemoteHTTPSHelper([]string{"git", "-c", extraHeader, "remote-https", remote, u.String()})
+}
+
+// ForwardRemoteHTTPSHelper exec the git-remote-https helper against a local forwarder listening on addr,
+// which takes care of authenticating each request. The caller can transparently pass-thru it.
+func ForwardRemoteHTTPSHelper(remote, url, addr string) {
+	u, err := _url.Parse(url)
+	if err != nil {
+		log.Fatal().Msgf("ForwardRemoteHTTPSHelper - could not parse %s: %s", url, err.Error())
+	}
+	// the config is written for the https:// URL
+	https := *u
+	https.Scheme = "https"
+	args := []string{"git"}
+	for _, c := range forwardedHTTPConfig(https.String()) {
+		args = append(args, "-c", fmt.Sprintf("http.%s=%s", c.Key, c.Value))
+	}
+
+	u.Scheme = "http"
+	u.Host = addr
+	u.User = nil
+	runRemoteHTTPSHelper(append(args, "remote-https", remote, u.String()))
+}
+
+// forwardedHTTPConfig returns the http.<url>.* entries that apply to url, ordered from the least to the most
+// specific, for git to apply them to the URL of the local forwarder too. Entries about the connection, such as
+// proxies and TLS, are left out: the forwarder makes the connections upstream, not git.
+func forwardedHTTPConfig(url string) []*GitConfig {
+	var configs []*GitConfig
+	for _, c := range ConfigGetRegexp(`^http\..+\..+$`) {
+		key := strings.ToLower(c.Key)
+		if strings.HasPrefix(key, "proxy") || strings.HasPrefix(key, "ssl") || key == "cookiefile" || !MatchURL(c.Url, url) {
+			continue
+		}
+		configs = append(configs, c)
+	}
+	sort.SliceStable(configs, func(i, j int) bool { return len(configs[i].Url) < len(configs[j].Url) })
+	return configs
+}
+
+func runRemoteHTTPSHelper(args []string) {
 	log.Debug().Msgf("passThruRemoteHTTPSHelper exec: %v", args)
 
 	binary, err := exec.LookPath(GitBinary)
@@ -146,12 +744,87 @@ func GetCredentials(protocol, host, username string) (string, error) {
 	return "", fmt.Errorf("[GetCredentials] Not found for protocol=%s,host=%s,username=%s", protocol, host, username)
 }
 
-// InstallProtocol configure Git to allow a given protocol on the system.
-func InstallProtocol(protocol string) {
-	protocol = fmt.Sprintf("protocol.%s.allow", protocol)
-	args := []string{"config", "--global", protocol, "always"}
-	cmd := exec.Command(GitBinary, args...)
-	if err := cmd.Run(); err != nil {
-		log.Fatal().Msgf("InstallProtocol - %s", err)
+// EraseCredentials removes credentials from the built-in git-credential-store helper.
+func EraseCredentials(protocol, host, username string) error {
+	var stdin bytes.Buffer
+
+	cmd := exec.Command(GitBinary, "credential-store", "erase")
+	// see: https://git-scm.com/docs/git-credential
+	params := fmt.Sprintf("protocol=%s\nhost=%s\nusername=%s\n", protocol, host, username)
+	stdin.Write([]byte(params))
+	cmd.Stdin = &stdin
+	res := cmd.Run()
+	if res == nil {
+		log.Debug().Msgf("EraseCredentials - credentials erased for protocol=%s,host=%s,username=%s", protocol, host, username)
 	}
+	return res
+}
+
+// A Credential is a description of credentials, as exchanged with credential helpers.
+// see: https://git-scm.com/docs/git-credential#IOFMT
+type Credential struct {
+	Protocol     string
+	Host         string
+	Path         string
+	Capabilities []string
+	AuthType     string
+	Credential   string
+}
+
+// ReadCredential parses the description of credentials sent by git to a credential helper.
+func ReadCredential(r io.Reader) (*Credential, error) {
+	var c Credential
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("ReadCredential - invalid line '%s'", line)
+		}
+		switch kv[0] {
+		case "protocol":
+			c.Protocol = kv[1]
+		case "host":
+			c.Host = kv[1]
+		case "path":
+			c.Path = kv[1]
+		case "capability[]":
+			c.Capabilities = append(c.Capabilities, kv[1])
+		case "authtype":
+			c.AuthType = kv[1]
+		case "credential":
+			c.Credential = kv[1]
+		}
+	}
+	return &c, scanner.Err()
+}
+
+// URL returns the URL described by the credential.
+func (c *Credential) URL() string {
+	return fmt.Sprintf("%s://%s/%s", c.Protocol, c.Host, c.Path)
+}
+
+// HasCapability reports whether git announced a capability of the credential protocol.
+func (c *Credential) HasCapability(capability string) bool {
+	for _, v := range c.Capabilities {
+		if v == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// InstallProtocol configure Git to allow a given protocol, in the given scope.
+func InstallProtocol(protocol string, scope ConfigScope) {
+	SetConfig(&GitConfig{
+		Url:     protocol,
+		Section: "protocol",
+		Key:     "allow",
+		Value:   "always",
+		Scope:   scope,
+	})
 }
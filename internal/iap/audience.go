@@ -0,0 +1,99 @@
+package iap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// AudienceCachePath is the directory where IAP auth tokens are cached per audience and account,
+	// so that every host behind the same IAP backend can reuse them.
+	AudienceCachePath = "~/.config/gcp-iap/audiences"
+)
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func audienceTokenPath(audience, account string) string {
+	name := fmt.Sprintf("%s_%s.jwt", unsafePathChars.ReplaceAllString(audience, "-"), unsafePathChars.ReplaceAllString(account, "-"))
+	return filepath.Join(ExpandHome(AudienceCachePath), name)
+}
+
+// readAudienceToken returns a cached IAP auth token for a given audience and account,
+// if it has not expired yet.
+func readAudienceToken(store TokenStore, audience, account string) (string, error) {
+	var rawToken string
+	var err error
+
+	if s, ok := store.(ExpiringTokenStore); ok {
+		rawToken, err = s.Get(audience, IDTokenAccount+":"+account)
+	} else {
+		var data []byte
+		data, err = ioutil.ReadFile(audienceTokenPath(audience, account))
+		rawToken = string(data)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, claims, err := parseJWToken(rawToken)
+	if err != nil {
+		return "", err
+	}
+	if claims.ExpiresAt < time.Now().Unix() {
+		return "", fmt.Errorf("[readAudienceToken] IAP auth token for audience %s has expired", audience)
+	}
+	return rawToken, nil
+}
+
+// cacheAudienceToken saves an IAP auth token for a given audience and account.
+func cacheAudienceToken(store TokenStore, audience, account, token string, exp int64) error {
+	if s, ok := store.(ExpiringTokenStore); ok {
+		return s.StoreUntil(audience, IDTokenAccount+":"+account, token, time.Unix(exp, 0))
+	}
+
+	path := audienceTokenPath(audience, account)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(token), 0600)
+}
+
+// EraseAudienceToken removes the IAP auth token cached for a given audience and account from store.
+func EraseAudienceToken(store TokenStore, audience, account string) error {
+	if s, ok := store.(ExpiringTokenStore); ok {
+		return s.Erase(audience, IDTokenAccount+":"+account)
+	}
+	return os.Remove(audienceTokenPath(audience, account))
+}
+
+// audienceCache is an iapauth.TokenCache keeping IAP auth tokens per audience for a given account,
+// either in the ExpiringTokenStore or under AudienceCachePath.
+type audienceCache struct {
+	store   TokenStore
+	account string
+}
+
+func (c *audienceCache) Get(audience string) (*oauth2.Token, error) {
+	rawToken, err := readAudienceToken(c.store, audience, c.account)
+	if err != nil {
+		log.Debug().Msgf("[audienceCache] No cached IAP auth token for audience %s: %v", audience, err)
+		return nil, err
+	}
+	return iapauth.ParseIDToken(rawToken)
+}
+
+func (c *audienceCache) Put(audience string, token *oauth2.Token) error {
+	err := cacheAudienceToken(c.store, audience, c.account, token.AccessToken, token.Expiry.Unix())
+	if err != nil {
+		log.Warn().Msgf("[audienceCache] Could not cache IAP auth token for audience %s: %s", audience, err.Error())
+	}
+	return err
+}
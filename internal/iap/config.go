@@ -0,0 +1,81 @@
+package iap
+
+import (
+	"fmt"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+)
+
+// RequiredConfig lists the git config keys needed to manage IAP auth for a URL.
+var RequiredConfig = []string{"iap.helperID", "iap.helperSecret", "iap.clientID", "http.cookieFile"}
+
+// CheckConfig returns an error naming the first required git config key that is missing for a URL.
+// Long-running processes use it to tell URLs configured for IAP from the others.
+func CheckConfig(domain string) error {
+	for _, key := range RequiredConfig {
+		if _, err := lookupConfig(key, domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupConfig reads a required git config key for a URL, and returns an error when it is missing
+// or cannot be read.
+func lookupConfig(key, domain string) (string, error) {
+	value, ok, err := git.ConfigURLMatch(key, domain)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%s is not configured for IAP: missing %s", domain, key)
+	}
+	return value, nil
+}
+
+// NewConfig returns the iapauth.Config of a given URL, read from the git config.
+// Refresh-tokens come from the TokenStore, or from the browser flow when there is none or
+// when forcebrowserflow is set. IAP auth tokens are cached per audience.
+func NewConfig(domain string, forcebrowserflow bool) (iapauth.Config, error) {
+	store, err := NewTokenStore(domain)
+	if err != nil {
+		return iapauth.Config{}, err
+	}
+	return newConfig(domain, store, forcebrowserflow)
+}
+
+func newConfig(domain string, store TokenStore, forcebrowserflow bool) (iapauth.Config, error) {
+	clientID, err := lookupConfig("iap.clientID", domain)
+	if err != nil {
+		return iapauth.Config{}, err
+	}
+	helperID, err := lookupConfig("iap.helperID", domain)
+	if err != nil {
+		return iapauth.Config{}, err
+	}
+	helperSecret, err := lookupConfig("iap.helperSecret", domain)
+	if err != nil {
+		return iapauth.Config{}, err
+	}
+	if helperSecret, err = ResolveHelperSecret(store, domain, helperSecret); err != nil {
+		return iapauth.Config{}, err
+	}
+	account, err := LookupAccount(domain)
+	if err != nil {
+		return iapauth.Config{}, err
+	}
+
+	return iapauth.Config{
+		ClientID:     clientID,
+		HelperID:     helperID,
+		HelperSecret: helperSecret,
+		Credentials: &gitCredentials{
+			domain:           domain,
+			account:          account,
+			store:            store,
+			forcebrowserflow: forcebrowserflow,
+		},
+		Cache: &audienceCache{store: store, account: account},
+	}, nil
+}
@@ -2,6 +2,7 @@ package iap
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net/url"
 	"os"
@@ -10,15 +11,19 @@ import (
 	"time"
 
 	jwt "github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
 
-	"github.com/adohkan/git-remote-https-iap/internal/git"
-	"github.com/rs/zerolog/log"
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
 )
 
 const (
 	// IAPCookieName is the name of the HTTP Cookie that will be used to send the IAP Token.
 	// see: https://cloud.google.com/blog/products/gcp/getting-started-with-cloud-identity-aware-proxy
 	IAPCookieName = "GCP_IAAP_AUTH_TOKEN"
+
+	// IDTokenAccount is the account used when saving the IAP auth token in an ExpiringTokenStore.
+	IDTokenAccount = "id-token"
 )
 
 // A Cookie holds pieces of information required to manage the IAP cookie
@@ -29,9 +34,33 @@ type Cookie struct {
 	Claims  jwt.StandardClaims
 }
 
-// ReadCookie lookup the http.cookieFile for a given domain and try to load it from the filesystem
+// An AudienceError is returned by ReadCookie when the cached IAP auth token is for another audience
+// than iap.clientID, e.g. a cookie jar left over from a previous clientID.
+type AudienceError struct {
+	CookieFile string
+	Audience   string
+	ClientID   string
+}
+
+func (e *AudienceError) Error() string {
+	return fmt.Sprintf("[ReadCookie] IAP cookie in %s is for audience %s, not %s", e.CookieFile, e.Audience, e.ClientID)
+}
+
+// ReadCookie lookup the http.cookieFile for a given URL and try to load it from the filesystem.
+// Config is resolved against the whole URL, so that paths of a single host can use different audiences.
 func ReadCookie(domain string) (*Cookie, error) {
-	cookieFile := git.ConfigGetURLMatch("http.cookieFile", domain)
+	cookieFile, err := lookupConfig("http.cookieFile", domain)
+	if err != nil {
+		return nil, err
+	}
+	IAPClientID, err := lookupConfig("iap.clientID", domain)
+	if err != nil {
+		return nil, err
+	}
+	account, err := LookupAccount(domain)
+	if err != nil {
+		return nil, err
+	}
 
 	url, err := url.Parse(domain)
 	if err != nil {
@@ -43,7 +72,17 @@ func ReadCookie(domain string) (*Cookie, error) {
 		Domain:  url.Host,
 	}
 
-	rawToken, err := c.readRawTokenFromJar()
+	store, err := NewTokenStore(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var rawToken string
+	if _, ok := store.(ExpiringTokenStore); ok {
+		rawToken, err = readAudienceToken(store, IAPClientID, account)
+	} else {
+		rawToken, err = c.readRawTokenFromJar()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +91,9 @@ func ReadCookie(domain string) (*Cookie, error) {
 	if err != nil {
 		return nil, err
 	}
+	if claims.Audience != IAPClientID {
+		return nil, &AudienceError{CookieFile: cookieFile, Audience: claims.Audience, ClientID: IAPClientID}
+	}
 
 	c.Token = token
 	c.Claims = claims
@@ -59,8 +101,28 @@ func ReadCookie(domain string) (*Cookie, error) {
 	return &c, nil
 }
 
+// CookieFromToken creates an IAP Cookie for a given URL from a raw IAP auth token obtained elsewhere,
+// without writing it on the filesystem.
+func CookieFromToken(domain, rawToken string) (*Cookie, error) {
+	url, err := url.Parse(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	token, claims, err := parseJWToken(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cookie{
+		Domain: url.Host,
+		Token:  token,
+		Claims: claims,
+	}, nil
+}
+
 func (c *Cookie) readRawTokenFromJar() (string, error) {
-	path := expandHome(c.JarPath)
+	path := ExpandHome(c.JarPath)
 
 	file, err := os.Open(path)
 	if err != nil {
@@ -91,15 +153,26 @@ func (c *Cookie) readRawTokenFromJar() (string, error) {
 	return "", fmt.Errorf("readRawTokenFromJar - %s not found", IAPCookieName)
 }
 
-// NewCookie takes care of the authentication workflow and creates the relevant IAP Cookie on the filesystem
+// NewCookie takes care of the authentication workflow and creates the relevant IAP Cookie on the filesystem.
+// Config is resolved against the whole URL, like in ReadCookie.
 func NewCookie(domain string, forcebrowserflow bool) (*Cookie, error) {
+	return newCookie(domain, forcebrowserflow, true)
+}
+
+// RefreshCookie is similar to NewCookie, but always mints a new IAP auth token
+// instead of reusing the one cached for the audience.
+func RefreshCookie(domain string) (*Cookie, error) {
+	return newCookie(domain, false, false)
+}
+
+func newCookie(domain string, forcebrowserflow, useCache bool) (*Cookie, error) {
 
 	log.Debug().Msgf("[NewCookie] Attempting to get NewCookie")
 
-	helperID := git.ConfigGetURLMatch("iap.helperID", domain)
-	helperSecret := git.ConfigGetURLMatch("iap.helperSecret", domain)
-	IAPClientID := git.ConfigGetURLMatch("iap.clientID", domain)
-	cookieFile := git.ConfigGetURLMatch("http.cookieFile", domain)
+	cookieFile, err := lookupConfig("http.cookieFile", domain)
+	if err != nil {
+		return nil, err
+	}
 
 	url, err := url.Parse(domain)
 	if err != nil {
@@ -107,14 +180,29 @@ func NewCookie(domain string, forcebrowserflow bool) (*Cookie, error) {
 		return nil, err
 	}
 
-	rawToken, err := GetIAPAuthToken(domain, helperID, helperSecret, IAPClientID, forcebrowserflow)
+	store, err := NewTokenStore(domain)
+	if err != nil {
+		return nil, err
+	}
+	config, err := newConfig(domain, store, forcebrowserflow)
 	if err != nil {
-		log.Debug().Msgf("[NewCookie] Failed to GetIAPAuthToken")
 		return nil, err
 	}
-	log.Debug().Msgf("rawToken: %+v", rawToken)
 
-	token, claims, err := parseJWToken(rawToken)
+	// hosts behind the same IAP backend share the same audience, and can reuse the same token
+	tokens := iapauth.NewTokenSource(context.Background(), config)
+	var t *oauth2.Token
+	if useCache && !forcebrowserflow {
+		t, err = tokens.Token()
+	} else {
+		t, err = tokens.Refresh()
+	}
+	if err != nil {
+		log.Debug().Msgf("[NewCookie] Failed to get IAP auth token")
+		return nil, err
+	}
+
+	token, claims, err := parseJWToken(t.AccessToken)
 	if err != nil {
 		log.Debug().Msgf("[NewCookie] Failed to parseJWToken")
 		return nil, err
@@ -126,11 +214,48 @@ func NewCookie(domain string, forcebrowserflow bool) (*Cookie, error) {
 		Token:   token,
 		Claims:  claims,
 	}
+
+	// ExpiringTokenStore already holds the token for this audience
+	if _, ok := store.(ExpiringTokenStore); ok {
+		return &c, nil
+	}
 	return &c, c.write(token.Raw, claims.ExpiresAt)
 }
 
+// EraseCookie removes the IAP auth token of a given URL from the cookie jar and from the cache of its audience,
+// so that the next call to NewCookie mints a new one.
+func EraseCookie(domain string) error {
+	store, err := NewTokenStore(domain)
+	if err != nil {
+		return err
+	}
+	clientID, err := lookupConfig("iap.clientID", domain)
+	if err != nil {
+		return err
+	}
+	account, err := LookupAccount(domain)
+	if err != nil {
+		return err
+	}
+	if err := EraseAudienceToken(store, clientID, account); err != nil {
+		log.Debug().Msgf("[EraseCookie] No cached IAP auth token to erase for %s: %s", domain, err)
+	}
+
+	if _, ok := store.(ExpiringTokenStore); ok {
+		return nil
+	}
+	cookieFile, err := lookupConfig("http.cookieFile", domain)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(ExpandHome(cookieFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 func (c *Cookie) write(token string, exp int64) error {
-	path := expandHome(c.JarPath)
+	path := ExpandHome(c.JarPath)
 	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return err
 	}
@@ -145,18 +270,33 @@ func (c *Cookie) write(token string, exp int64) error {
 		return err
 	}
 
-	if _, err = f.WriteString(fmt.Sprintf("%s\tx\tx\tx\t%d\t%s\t%s\n", c.Domain, exp, IAPCookieName, token)); err != nil {
+	if _, err = f.WriteString(jarLine(c.Domain, token, exp) + "\n"); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// JarLine returns the IAP Cookie as a line of a Netscape cookie jar, as understood by git and curl.
+func (c *Cookie) JarLine() string {
+	return jarLine(c.Domain, c.Token.Raw, c.Claims.ExpiresAt)
+}
+
+func jarLine(domain, token string, exp int64) string {
+	// see: https://curl.haxx.se/docs/http-cookies.html
+	return fmt.Sprintf("%s\tx\tx\tx\t%d\t%s\t%s", domain, exp, IAPCookieName, token)
+}
+
 // Expired returns a boolean that indicate if the expires-at claim is in the future
 func (c *Cookie) Expired() bool {
 	return c.Claims.ExpiresAt < time.Now().Unix()
 }
 
+// ExpiresWithin returns a boolean that indicate if the expires-at claim is less than d in the future
+func (c *Cookie) ExpiresWithin(d time.Duration) bool {
+	return c.Claims.ExpiresAt < time.Now().Add(d).Unix()
+}
+
 func parseJWToken(rawToken string) (jwt.Token, jwt.StandardClaims, error) {
 	var p jwt.Parser
 	var claims jwt.StandardClaims
@@ -164,11 +304,13 @@ func parseJWToken(rawToken string) (jwt.Token, jwt.StandardClaims, error) {
 	token, _, err := p.ParseUnverified(rawToken, &claims)
 	if err != nil {
 		log.Debug().Msgf("Token parse failed. It might not have refreshed properly. Is your account locked or invalid? If not: Try clearing ~/.git-credentials and ~/.config/gcp-iap/*.cookie")
+		return jwt.Token{}, claims, err
 	}
 	return *token, claims, err
 }
 
-func expandHome(path string) string {
+// ExpandHome replaces a leading '~' in path with the home directory of the user.
+func ExpandHome(path string) string {
 	if len(path) == 0 || path[0] != '~' {
 		return path
 	}
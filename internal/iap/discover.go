@@ -0,0 +1,186 @@
+package iap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+)
+
+const (
+	// GoogleSignInHost is the host IAP redirects unauthenticated browsers to.
+	GoogleSignInHost = "accounts.google.com"
+
+	// WellKnownPath is where DiscoverOrgConfig looks for the document of an organisation,
+	// when given a URL without path.
+	WellKnownPath = "/.well-known/git-iap.json"
+
+	// OrgConfigVersion is the version of the documents understood by DiscoverOrgConfig.
+	OrgConfigVersion = 1
+
+	maxDiscoveryRedirects = 5
+)
+
+// DiscoverClientID finds the OAuth Client ID of the IAP instance protecting a URL, by making an
+// unauthenticated request and reading the 'client_id' parameter of the redirection to the Google sign-in page.
+func DiscoverClientID(domain string) (string, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	next := domain
+	for i := 0; i < maxDiscoveryRedirects; i++ {
+		req, err := http.NewRequest(http.MethodGet, next, nil)
+		if err != nil {
+			return "", err
+		}
+		// IAP answers 401 instead of redirecting to the sign-in page when the request does not look like it comes from a browser
+		req.Header.Set("Accept", "text/html")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("[DiscoverClientID] Could not reach %s: %w", domain, err)
+		}
+		resp.Body.Close()
+
+		loc, err := resp.Location()
+		if err != nil {
+			return "", fmt.Errorf("[DiscoverClientID] %s answered %d, it does not look protected by IAP", domain, resp.StatusCode)
+		}
+		log.Debug().Msgf("[DiscoverClientID] %s redirects to %s", next, loc)
+
+		if loc.Host == GoogleSignInHost {
+			clientID := loc.Query().Get("client_id")
+			if clientID == "" {
+				return "", fmt.Errorf("[DiscoverClientID] No client_id in the redirection of %s to %s", domain, GoogleSignInHost)
+			}
+			return clientID, nil
+		}
+		if loc.Host != req.URL.Host {
+			return "", fmt.Errorf("[DiscoverClientID] %s redirects to %s, it does not look protected by IAP", domain, loc.Host)
+		}
+		next = loc.String()
+	}
+	return "", fmt.Errorf("[DiscoverClientID] Too many redirects for %s", domain)
+}
+
+// An OrgConfig is a document published by an organisation, listing the IAP configuration of its hosts.
+// HelperID and HelperSecret apply to every host that does not set its own.
+type OrgConfig struct {
+	Version      int       `json:"version"`
+	HelperID     string    `json:"helperID,omitempty"`
+	HelperSecret string    `json:"helperSecret,omitempty"`
+	Hosts        []OrgHost `json:"hosts"`
+}
+
+// An OrgHost is the IAP configuration of a host, or of a path of a host when ScopePath is set.
+// ClientID is discovered with DiscoverClientID when omitted.
+type OrgHost struct {
+	URL          string `json:"url"`
+	ClientID     string `json:"clientID,omitempty"`
+	HelperID     string `json:"helperID,omitempty"`
+	HelperSecret string `json:"helperSecret,omitempty"`
+	ScopePath    bool   `json:"scopePath,omitempty"`
+}
+
+// DiscoverOrgConfig reads the OrgConfig of an organisation from an https:// URL, or from a file.
+// Hosts are returned with the default HelperID and HelperSecret applied.
+func DiscoverOrgConfig(location string) (*OrgConfig, error) {
+	data, err := readOrgConfig(location)
+	if err != nil {
+		return nil, err
+	}
+
+	var c OrgConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("[DiscoverOrgConfig] Could not parse %s: %w", location, err)
+	}
+
+	for i := range c.Hosts {
+		if c.Hosts[i].HelperID == "" {
+			c.Hosts[i].HelperID = c.HelperID
+		}
+		if c.Hosts[i].HelperSecret == "" {
+			c.Hosts[i].HelperSecret = c.HelperSecret
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("[DiscoverOrgConfig] Invalid %s: %w", location, err)
+	}
+	return &c, nil
+}
+
+// Validate returns an error describing the first problem found in an OrgConfig.
+func (c *OrgConfig) Validate() error {
+	if c.Version != OrgConfigVersion {
+		return fmt.Errorf("unsupported version %d, expected %d", c.Version, OrgConfigVersion)
+	}
+	if len(c.Hosts) == 0 {
+		return fmt.Errorf("no hosts")
+	}
+	for i, h := range c.Hosts {
+		u, err := url.Parse(h.URL)
+		switch {
+		case err != nil:
+			return fmt.Errorf("hosts[%d]: invalid url '%s': %w", i, h.URL, err)
+		case u.Scheme != "https" || u.Host == "":
+			return fmt.Errorf("hosts[%d]: url '%s' must be https://", i, h.URL)
+		case h.HelperID == "":
+			return fmt.Errorf("hosts[%d]: missing helperID", i)
+		case h.HelperSecret == "":
+			return fmt.Errorf("hosts[%d]: missing helperSecret", i)
+		case h.ClientID == "" && strings.Contains(u.Host, "*"):
+			return fmt.Errorf("hosts[%d]: clientID is required for wildcard hosts", i)
+		}
+	}
+	return nil
+}
+
+func readOrgConfig(location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err == nil && u.Scheme == "http" {
+		return nil, fmt.Errorf("[DiscoverOrgConfig] Refusing to fetch %s over plain http", location)
+	}
+	if err != nil || u.Scheme != "https" {
+		return ioutil.ReadFile(ExpandHome(strings.TrimPrefix(location, "file://")))
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = WellKnownPath
+	}
+
+	// redirects are not followed: on a host protected by IAP, they lead to the Google sign-in page
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("[DiscoverOrgConfig] Could not fetch %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if iapauth.IsIAPBounce(resp) {
+		return nil, fmt.Errorf("[DiscoverOrgConfig] %s is protected by IAP: publish it on a host that is not, or pass a file", u)
+	}
+	if loc, err := resp.Location(); err == nil {
+		return nil, fmt.Errorf("[DiscoverOrgConfig] Could not fetch %s: HTTP %d, redirected to %s", u, resp.StatusCode, loc)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[DiscoverOrgConfig] Could not fetch %s: HTTP %d", u, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,104 @@
+package iap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newIAPStandIn returns a server redirecting every request to the Google sign-in page, like IAP,
+// after redirecting /old to /new on the same host.
+func newIAPStandIn(t *testing.T, signIn string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		http.Redirect(w, r, signIn, http.StatusFound)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDiscoverClientID(t *testing.T) {
+	srv := newIAPStandIn(t, "https://accounts.google.com/o/oauth2/v2/auth?client_id=123-abc.apps.googleusercontent.com&response_type=code")
+
+	for _, path := range []string{"/repo.git", "/old"} {
+		got, err := DiscoverClientID(srv.URL + path)
+		if err != nil {
+			t.Fatalf("DiscoverClientID(%s): %s", path, err)
+		}
+		if got != "123-abc.apps.googleusercontent.com" {
+			t.Errorf("DiscoverClientID(%s) = %q, want the client_id of the redirection", path, got)
+		}
+	}
+}
+
+func TestDiscoverClientIDErrors(t *testing.T) {
+	noClientID := newIAPStandIn(t, "https://accounts.google.com/o/oauth2/v2/auth?response_type=code")
+	elsewhere := newIAPStandIn(t, "https://sso.example.com/login")
+	notIAP := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer notIAP.Close()
+
+	for url, want := range map[string]string{
+		noClientID.URL: "No client_id",
+		elsewhere.URL:  "does not look protected by IAP",
+		notIAP.URL:     "answered 200, it does not look protected by IAP",
+	} {
+		_, err := DiscoverClientID(url)
+		if err == nil {
+			t.Errorf("DiscoverClientID(%s) should fail", url)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("DiscoverClientID(%s) = %q, want an error containing %q", url, err, want)
+		}
+	}
+}
+
+func TestDiscoverOrgConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case WellKnownPath:
+			w.Write([]byte(`{"version": 1, "helperID": "hid", "helperSecret": "sek", "hosts": [{"url": "https://git.domain.acme", "clientID": "cid"}]}`))
+		case "/protected.json":
+			http.Redirect(w, r, "https://accounts.google.com/o/oauth2/v2/auth?client_id=cid", http.StatusFound)
+		case "/moved.json":
+			http.Redirect(w, r, WellKnownPath, http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// trust the certificate of the server
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+
+	c, err := DiscoverOrgConfig(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Hosts) != 1 || c.Hosts[0].HelperID != "hid" || c.Hosts[0].HelperSecret != "sek" {
+		t.Errorf("hosts = %+v, want a single host with the default helper", c.Hosts)
+	}
+
+	for path, want := range map[string]string{
+		"/protected.json": "is protected by IAP",
+		"/moved.json":     "redirected to",
+		"/missing.json":   "HTTP 404",
+	} {
+		_, err := DiscoverOrgConfig(srv.URL + path)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("DiscoverOrgConfig(%s) = %v, want an error containing %q", path, err, want)
+		}
+	}
+	if _, err := DiscoverOrgConfig(strings.Replace(srv.URL, "https://", "http://", 1)); err == nil {
+		t.Error("DiscoverOrgConfig should refuse plain http")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package iap
+
+// lockFile only relies on the in-process lock of the caller on this platform.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,92 @@
+package iap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+)
+
+const (
+	// HelperSecretRefPrefix marks an 'iap.helperSecret' value as a reference to a secret held in the TokenStore,
+	// rather than the secret itself.
+	HelperSecretRefPrefix = "store:"
+
+	// HelperSecretAccount is the account used when saving the helper's OAuth Client Secret in the TokenStore.
+	// Secrets are saved per helperID, so that every URL using the same helper can resolve them.
+	HelperSecretAccount = "helper-secret"
+
+	// HelperSecretHostPrefix is prepended to the helperID to form the host a secret is saved for, so that
+	// it never shares a key with the refresh tokens saved for the helperID, whatever 'iap.account' is.
+	// A ':' would be read as a port by git-credential-store.
+	HelperSecretHostPrefix = "helper-secret."
+)
+
+// helperSecretHost returns the host the OAuth Client Secret of a helper is saved for in the TokenStore.
+func helperSecretHost(helperID string) string {
+	return HelperSecretHostPrefix + helperID
+}
+
+// StoreHelperSecret saves the OAuth Client Secret of the helper in the TokenStore selected for a given domain,
+// and returns the reference to be written in 'iap.helperSecret'.
+// The default store keeps it in plaintext as well, only out of the git config: a warning says so.
+func StoreHelperSecret(domain, helperID, secret string) (string, error) {
+	store, err := NewTokenStore(domain)
+	if err != nil {
+		return "", err
+	}
+	switch store.(type) {
+	case ExpiringTokenStore:
+		return "", fmt.Errorf("[StoreHelperSecret] Cannot store helperSecret for %s in a token store that expires secrets", domain)
+	case *credentialStore:
+		log.Warn().Msgf("[StoreHelperSecret] With iap.tokenStore=%s, helperSecret for %s is moved to ~/.git-credentials, which is not encrypted either: consider iap.tokenStore=%s", TokenStoreCredentialStore, domain, TokenStoreEncryptedFile)
+	}
+
+	if err := store.Store(helperSecretHost(helperID), HelperSecretAccount, secret); err != nil {
+		return "", err
+	}
+	return HelperSecretRefPrefix + helperID, nil
+}
+
+// ResolveHelperSecret returns the OAuth Client Secret of the helper from an 'iap.helperSecret' value,
+// looking it up in store when the value is a reference.
+func ResolveHelperSecret(store TokenStore, domain, value string) (string, error) {
+	if !IsHelperSecretRef(value) {
+		return value, nil
+	}
+
+	helperID := strings.TrimPrefix(value, HelperSecretRefPrefix)
+	secret, err := store.Get(helperSecretHost(helperID), HelperSecretAccount)
+	if err == nil {
+		return secret, nil
+	}
+
+	// secrets used to be saved for the helperID itself, where a refresh token of account 'helper-secret' would replace them
+	legacy, legacyErr := store.Get(helperID, HelperSecretAccount)
+	if legacyErr != nil {
+		return "", fmt.Errorf("[ResolveHelperSecret] Could not resolve helperSecret for %s: %w", domain, err)
+	}
+	if err := store.Store(helperSecretHost(helperID), HelperSecretAccount, legacy); err != nil {
+		log.Warn().Msgf("[ResolveHelperSecret] Could not move helperSecret of %s under its own key: %s", helperID, err)
+		return legacy, nil
+	}
+	if err := store.Erase(helperID, HelperSecretAccount); err != nil {
+		log.Warn().Msgf("[ResolveHelperSecret] Could not erase helperSecret of %s from its former key: %s", helperID, err)
+	}
+	log.Debug().Msgf("[ResolveHelperSecret] Moved helperSecret of %s under its own key", helperID)
+	return legacy, nil
+}
+
+// IsHelperSecretRef reports whether an 'iap.helperSecret' value is a reference to the TokenStore.
+func IsHelperSecretRef(value string) bool {
+	return strings.HasPrefix(value, HelperSecretRefPrefix)
+}
+
+// EraseHelperSecret removes the OAuth Client Secret of a helper from store, including a secret
+// left under its former key.
+func EraseHelperSecret(store TokenStore, helperID string) error {
+	if err := store.Erase(helperID, HelperSecretAccount); err != nil {
+		log.Debug().Msgf("[EraseHelperSecret] No helperSecret of %s under its former key: %s", helperID, err)
+	}
+	return store.Erase(helperSecretHost(helperID), HelperSecretAccount)
+}
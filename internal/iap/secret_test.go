@@ -0,0 +1,47 @@
+package iap
+
+import "testing"
+
+func TestHelperSecretKey(t *testing.T) {
+	const helperID = "123-abc.apps.googleusercontent.com"
+	store := &memoryStore{entries: secrets{}}
+	ref := HelperSecretRefPrefix + helperID
+
+	// a refresh token of an account named like the secrets does not replace them
+	if err := store.Store(helperSecretHost(helperID), HelperSecretAccount, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacheRefreshToken(store, helperID, HelperSecretAccount, "refresh"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ResolveHelperSecret(store, "https://git.example.com", ref); err != nil || got != "secret" {
+		t.Errorf("ResolveHelperSecret = %q, %v, want the secret", got, err)
+	}
+	if got, err := store.Get(helperID, HelperSecretAccount); err != nil || got != "refresh" {
+		t.Errorf("refresh token = %q, %v, want it kept", got, err)
+	}
+}
+
+func TestHelperSecretLegacyKey(t *testing.T) {
+	const helperID = "123-abc.apps.googleusercontent.com"
+	store := &memoryStore{entries: secrets{helperID: {HelperSecretAccount: "secret"}}}
+	ref := HelperSecretRefPrefix + helperID
+
+	// secrets saved for the helperID itself are moved under their own key
+	if got, err := ResolveHelperSecret(store, "https://git.example.com", ref); err != nil || got != "secret" {
+		t.Fatalf("ResolveHelperSecret = %q, %v, want the secret of the former key", got, err)
+	}
+	if _, err := store.Get(helperID, HelperSecretAccount); err == nil {
+		t.Error("the secret is left under its former key")
+	}
+	if got, err := store.Get(helperSecretHost(helperID), HelperSecretAccount); err != nil || got != "secret" {
+		t.Errorf("secret under its own key = %q, %v", got, err)
+	}
+
+	if err := EraseHelperSecret(store, helperID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveHelperSecret(store, "https://git.example.com", ref); err == nil {
+		t.Error("ResolveHelperSecret should fail once the secret is erased")
+	}
+}
@@ -0,0 +1,96 @@
+package iap
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+// A HostStatus describes the IAP configuration of a URL, and the health of its tokens.
+type HostStatus struct {
+	URL        string `json:"url"`
+	ClientID   string `json:"clientID"`
+	HelperID   string `json:"helperID"`
+	Account    string `json:"account"`
+	CookieFile string `json:"cookieFile,omitempty"`
+
+	// Expiry, Email and Audience describe the current IAP auth token, if any
+	Expiry   *time.Time `json:"expiry,omitempty"`
+	Email    string     `json:"email,omitempty"`
+	Audience string     `json:"audience,omitempty"`
+
+	// RefreshTokenCached tells whether a refresh token is cached. It is not checked with Google:
+	// a cached refresh token may have been revoked, or have expired.
+	RefreshTokenCached bool `json:"refreshTokenCached"`
+	// NeedsLogin tells whether the next refresh of the IAP auth token opens the browser, since no refresh token is cached
+	NeedsLogin bool `json:"needsLogin"`
+	// Locked tells that the token store was not read, as it would have prompted for its passphrase
+	Locked bool `json:"locked,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Valid reports whether the current IAP auth token has not expired.
+func (s *HostStatus) Valid() bool {
+	return s.Expiry != nil && s.Expiry.After(time.Now())
+}
+
+// Status inspects the tokens of a URL configured for IAP. Its config is given, as read by the caller,
+// so that many URLs can be inspected without resolving each of their keys with 'git config'.
+// Unless prompt is set, a token store that would prompt for its passphrase is not read, and the status is Locked.
+// Stores are never changed.
+func Status(domain, clientID, helperID, account, cookieFile string, prompt bool) *HostStatus {
+	s := &HostStatus{
+		URL:        domain,
+		ClientID:   clientID,
+		HelperID:   helperID,
+		Account:    account,
+		CookieFile: cookieFile,
+	}
+
+	store, err := NewTokenStore(domain)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+
+	if l, ok := store.(LockableTokenStore); ok && !prompt && l.Locked() {
+		s.Locked = true
+	}
+
+	var rawToken string
+	if _, ok := store.(ExpiringTokenStore); ok {
+		s.CookieFile = ""
+		rawToken, _ = readAudienceToken(store, clientID, account)
+	} else if cookieFile != "" {
+		rawToken, _ = (&Cookie{JarPath: cookieFile}).readRawTokenFromJar()
+	}
+	if rawToken != "" {
+		var claims struct {
+			jwt.StandardClaims
+			Email string `json:"email"`
+		}
+		if _, _, err := new(jwt.Parser).ParseUnverified(rawToken, &claims); err != nil {
+			s.Error = fmt.Sprintf("could not parse IAP auth token: %s", err)
+		} else {
+			exp := time.Unix(claims.ExpiresAt, 0)
+			s.Expiry, s.Email, s.Audience = &exp, claims.Email, claims.Audience
+		}
+	}
+
+	if s.Locked {
+		return s
+	}
+	// the store is only read: secrets are migrated by the next refresh, not by Status
+	if _, err := peek(store, helperID, account); err == nil {
+		s.RefreshTokenCached = true
+	} else if u, err := url.Parse(domain); err == nil {
+		// not migrated yet, see getRefreshTokenFromCache
+		_, err := peek(store, fmt.Sprintf("%s://%s", u.Scheme, u.Host), CacheUsername)
+		s.RefreshTokenCached = err == nil
+	}
+	s.NeedsLogin = !s.RefreshTokenCached
+	return s
+}
@@ -0,0 +1,109 @@
+package iap
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+// setupTestHome points git, git-credential-store and the token stores at an empty home directory.
+func setupTestHome(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	return home
+}
+
+func newTestIDToken(t *testing.T, audience string, d time.Duration) string {
+	t.Helper()
+	raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"aud":   audience,
+		"exp":   time.Now().Add(d).Unix(),
+		"email": "user@example.com",
+	}).SignedString([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestStatus(t *testing.T) {
+	const domain = "https://git.example.com"
+
+	for _, tc := range []struct {
+		name string
+		// jar is the validity of the token in the cookie jar, none when zero
+		jar        time.Duration
+		tokenStore string
+		refresh    func(store TokenStore) error
+
+		wantValid, wantExpiry, wantCached, wantLocked bool
+	}{
+		{name: "nothing cached"},
+		{
+			name:      "valid token and refresh token",
+			jar:       time.Hour,
+			refresh:   func(s TokenStore) error { return cacheRefreshToken(s, "helper-id", DefaultAccount, "refresh") },
+			wantValid: true, wantExpiry: true, wantCached: true,
+		},
+		{name: "expired token", jar: -time.Hour, wantExpiry: true},
+		{
+			name:       "refresh token cached per domain",
+			refresh:    func(s TokenStore) error { return s.Store(domain, CacheUsername, "refresh") },
+			wantCached: true,
+		},
+		{name: "locked store", jar: time.Hour, tokenStore: TokenStoreEncryptedFile, wantValid: true, wantExpiry: true, wantLocked: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			home := setupTestHome(t)
+			if tc.tokenStore != "" {
+				if out, err := exec.Command("git", "config", "--global", "iap.tokenStore", tc.tokenStore).CombinedOutput(); err != nil {
+					t.Fatalf("git config: %s\n%s", err, out)
+				}
+			}
+			cookieFile := filepath.Join(home, "cookie")
+			if tc.jar != 0 {
+				line := jarLine("git.example.com", newTestIDToken(t, "client-id", tc.jar), time.Now().Add(tc.jar).Unix())
+				if err := ioutil.WriteFile(cookieFile, []byte(line+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.refresh != nil {
+				store, err := NewTokenStore(domain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := tc.refresh(store); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// tests never prompt for the passphrase of the store
+			s := Status(domain, "client-id", "helper-id", DefaultAccount, cookieFile, false)
+			if s.Error != "" {
+				t.Fatalf("Status error: %s", s.Error)
+			}
+			if s.Valid() != tc.wantValid || (s.Expiry != nil) != tc.wantExpiry {
+				t.Errorf("got valid=%t, expiry=%v, want valid=%t, expiry=%t", s.Valid(), s.Expiry, tc.wantValid, tc.wantExpiry)
+			}
+			if tc.wantExpiry && (s.Audience != "client-id" || s.Email != "user@example.com") {
+				t.Errorf("got audience=%q, email=%q, want the claims of the token", s.Audience, s.Email)
+			}
+			if s.RefreshTokenCached != tc.wantCached || s.NeedsLogin != (!tc.wantCached && !tc.wantLocked) {
+				t.Errorf("got refreshTokenCached=%t, needsLogin=%t, want cached=%t", s.RefreshTokenCached, s.NeedsLogin, tc.wantCached)
+			}
+			if s.Locked != tc.wantLocked {
+				t.Errorf("got locked=%t, want %t", s.Locked, tc.wantLocked)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package iap
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+)
+
+const (
+	// TokenStoreCredentialStore selects the built-in git-credential-store helper to persist refresh-tokens.
+	// This is the default store.
+	TokenStoreCredentialStore = "git-credential-store"
+
+	// TokenStoreEncryptedFile selects an encrypted file under ~/.config/gcp-iap/ to persist refresh-tokens.
+	TokenStoreEncryptedFile = "encrypted-file"
+
+	// TokenStoreKernelKeyring selects the Linux kernel keyring to hold refresh-tokens and IAP auth tokens.
+	TokenStoreKernelKeyring = "kernel-keyring"
+
+	// DefaultKeyringTimeout is how long refresh-tokens are kept in the kernel keyring,
+	// unless 'iap.keyringTimeout' says otherwise.
+	DefaultKeyringTimeout = 12 * time.Hour
+)
+
+// A TokenStore persists secrets, such as refresh-tokens, for a given host and account.
+type TokenStore interface {
+	Get(host, account string) (string, error)
+	Store(host, account, secret string) error
+	Erase(host, account string) error
+}
+
+// An ExpiringTokenStore is a TokenStore that can hold a secret until a given time.
+// When the selected store implements it, IAP auth tokens are kept in the store
+// rather than written to the cookie jar.
+type ExpiringTokenStore interface {
+	TokenStore
+	StoreUntil(host, account, secret string, exp time.Time) error
+}
+
+// A LockableTokenStore is a TokenStore that may prompt the user before it can be read.
+type LockableTokenStore interface {
+	TokenStore
+	// Locked reports whether the next read prompts the user.
+	Locked() bool
+}
+
+// A PeekableTokenStore is a TokenStore whose Get may change the store, such as migrating the secret it finds.
+type PeekableTokenStore interface {
+	TokenStore
+	// Peek is similar to Get, but leaves the store unchanged.
+	Peek(host, account string) (string, error)
+}
+
+// peek reads a secret from a store without changing it, with Peek when the store implements it.
+func peek(store TokenStore, host, account string) (string, error) {
+	if p, ok := store.(PeekableTokenStore); ok {
+		return p.Peek(host, account)
+	}
+	return store.Get(host, account)
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = map[string]TokenStore{}
+)
+
+// NewTokenStore returns the TokenStore selected by 'iap.tokenStore' for a given domain.
+// Stores are shared for the lifetime of the process, so that a passphrase is asked for at most once.
+func NewTokenStore(domain string) (TokenStore, error) {
+	kind, _, err := git.ConfigURLMatch("iap.tokenStore", domain)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "", TokenStoreCredentialStore:
+		return cachedTokenStore(TokenStoreCredentialStore, func() (TokenStore, error) {
+			return &credentialStore{}, nil
+		})
+	case TokenStoreEncryptedFile:
+		keyFile, _, err := git.ConfigURLMatch("iap.tokenStoreKeyFile", domain)
+		if err != nil {
+			return nil, err
+		}
+		return cachedTokenStore(kind+":"+keyFile, func() (TokenStore, error) {
+			return &encryptedFileStore{
+				Path:     EncryptedStorePath,
+				KeyFile:  keyFile,
+				Fallback: &credentialStore{},
+			}, nil
+		})
+	case TokenStoreKernelKeyring:
+		keyring, _, err := git.ConfigURLMatch("iap.keyring", domain)
+		if err != nil {
+			return nil, err
+		}
+		timeout := DefaultKeyringTimeout
+		v, ok, err := git.ConfigURLMatch("iap.keyringTimeout", domain)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return nil, fmt.Errorf("[NewTokenStore] Invalid iap.keyringTimeout '%s' for %s", v, domain)
+			}
+			timeout = time.Duration(secs) * time.Second
+		}
+		return cachedTokenStore(fmt.Sprintf("%s:%s:%s", kind, keyring, timeout), func() (TokenStore, error) {
+			return newKeyringStore(keyring, timeout)
+		})
+	default:
+		return nil, fmt.Errorf("[NewTokenStore] Unknown iap.tokenStore '%s' for %s", kind, domain)
+	}
+}
+
+// cachedTokenStore returns the store previously built for key, or builds it with newStore.
+func cachedTokenStore(key string, newStore func() (TokenStore, error)) (TokenStore, error) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if store, ok := stores[key]; ok {
+		return store, nil
+	}
+	store, err := newStore()
+	if err != nil {
+		return nil, err
+	}
+	stores[key] = store
+	return store, nil
+}
+
+// credentialStore persists secrets using the built-in git-credential-store helper.
+// Its calls are serialized, as git-credential-store fails instead of waiting when its lock is held.
+type credentialStore struct{}
+
+var credentialsMu sync.Mutex
+
+func (s *credentialStore) Get(host, account string) (string, error) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	return git.GetCredentials(CacheProtocol, host, account)
+}
+
+func (s *credentialStore) Store(host, account, secret string) error {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	return git.StoreCredentials(CacheProtocol, host, account, secret)
+}
+
+func (s *credentialStore) Erase(host, account string) error {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	return git.EraseCredentials(CacheProtocol, host, account)
+}
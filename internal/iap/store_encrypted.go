@@ -0,0 +1,354 @@
+package iap
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const (
+	// EncryptedStorePath is the location of the file used by the 'encrypted-file' token store.
+	EncryptedStorePath = "~/.config/gcp-iap/tokens.enc"
+
+	// EncryptedStoreVersion is the version of the on-disk format of the 'encrypted-file' token store.
+	EncryptedStoreVersion = 1
+
+	// TTYPath is the terminal used to prompt for the passphrase of the 'encrypted-file' token store.
+	TTYPath = "/dev/tty"
+)
+
+// encryptedFile is the on-disk representation of the 'encrypted-file' token store.
+// The payload is a JSON encoded map of host -> account -> secret, sealed with AES-256-GCM
+// using a key derived from a passphrase (or a key file) with scrypt.
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type secrets map[string]map[string]string
+
+// encryptedFileStore persists secrets in a single file encrypted at rest.
+// Secrets found in Fallback are migrated on first access.
+// Changes are made under a lock, so that concurrent processes and goroutines do not lose each other's updates.
+type encryptedFileStore struct {
+	Path     string
+	KeyFile  string
+	Fallback TokenStore
+
+	mu         sync.Mutex
+	passphrase []byte
+}
+
+func (s *encryptedFileStore) Get(host, account string) (string, error) {
+	var secret string
+	migrated := false
+	err := s.update(func(entries secrets) (bool, error) {
+		if v, ok := entries[host][account]; ok {
+			log.Debug().Msgf("[encryptedFileStore.Get] Found secret for host=%s,account=%s", host, account)
+			secret = v
+			return false, nil
+		}
+
+		if s.Fallback != nil {
+			if v, err := s.Fallback.Get(host, account); err == nil {
+				log.Debug().Msgf("[encryptedFileStore.Get] Migrating secret for host=%s,account=%s", host, account)
+				entries.set(host, account, v)
+				secret, migrated = v, true
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("[encryptedFileStore.Get] Not found for host=%s,account=%s", host, account)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if migrated {
+		if err := s.Fallback.Erase(host, account); err != nil {
+			log.Warn().Msgf("[encryptedFileStore.Get] Could not erase migrated secret for host=%s,account=%s: %s", host, account, err)
+		}
+	}
+	return secret, nil
+}
+
+// Peek is similar to Get, but does not migrate the secrets found in Fallback.
+// The file is replaced atomically by updates, so it is read without taking its lock.
+func (s *encryptedFileStore) Peek(host, account string) (string, error) {
+	s.mu.Lock()
+	entries, _, err := s.load()
+	s.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if v, ok := entries[host][account]; ok {
+		return v, nil
+	}
+	if s.Fallback != nil {
+		return s.Fallback.Get(host, account)
+	}
+	return "", fmt.Errorf("[encryptedFileStore.Peek] Not found for host=%s,account=%s", host, account)
+}
+
+func (s *encryptedFileStore) Store(host, account, secret string) error {
+	return s.update(func(entries secrets) (bool, error) {
+		entries.set(host, account, secret)
+		return true, nil
+	})
+}
+
+func (s *encryptedFileStore) Erase(host, account string) error {
+	return s.update(func(entries secrets) (bool, error) {
+		if _, ok := entries[host][account]; !ok {
+			return false, nil
+		}
+		delete(entries[host], account)
+		if len(entries[host]) == 0 {
+			delete(entries, host)
+		}
+		return true, nil
+	})
+}
+
+func (e secrets) set(host, account, secret string) {
+	if e[host] == nil {
+		e[host] = map[string]string{}
+	}
+	e[host][account] = secret
+}
+
+// update decrypts the store and passes its secrets to fn, then saves them if fn reports a change.
+// The store is locked meanwhile, against other goroutines and other processes.
+func (s *encryptedFileStore) update(fn func(secrets) (bool, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := ExpandHome(s.Path)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, salt, err := s.load()
+	if err != nil {
+		return err
+	}
+	changed, err := fn(entries)
+	if err != nil || !changed {
+		return err
+	}
+	return s.save(entries, salt)
+}
+
+// load decrypts the store. A missing file is treated as an empty store.
+func (s *encryptedFileStore) load() (secrets, []byte, error) {
+	entries := secrets{}
+
+	data, err := ioutil.ReadFile(ExpandHome(s.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+		return entries, salt, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var f encryptedFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, nil, fmt.Errorf("[encryptedFileStore] Could not parse %s: %w", s.Path, err)
+	}
+	if f.Version != EncryptedStoreVersion {
+		return nil, nil, fmt.Errorf("[encryptedFileStore] Unsupported version %d in %s", f.Version, s.Path)
+	}
+
+	aead, err := s.cipher(f.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := aead.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		// stores are shared per process: forget the secret, so that the next access asks for it again
+		s.passphrase = nil
+		return nil, nil, fmt.Errorf("[encryptedFileStore] Could not decrypt %s: wrong passphrase or key file?", s.Path)
+	}
+	if err := json.Unmarshal(plaintext, &entries); err != nil {
+		return nil, nil, fmt.Errorf("[encryptedFileStore] Could not parse decrypted %s: %w", s.Path, err)
+	}
+
+	return entries, f.Salt, nil
+}
+
+// save encrypts the store into a temporary file next to it, which then replaces it.
+func (s *encryptedFileStore) save(entries secrets, salt []byte) error {
+	plaintext, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	aead, err := s.cipher(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(encryptedFile{
+		Version:    EncryptedStoreVersion,
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, nil),
+	})
+	if err != nil {
+		return err
+	}
+
+	path := ExpandHome(s.Path)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *encryptedFileStore) cipher(salt []byte) (cipher.AEAD, error) {
+	secret, err := s.secret()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := scrypt.Key(secret, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Locked reports whether the next read prompts for the passphrase.
+func (s *encryptedFileStore) Locked() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.passphrase == nil && s.KeyFile == ""
+}
+
+// secret returns the content of the key file when configured, or prompts for a passphrase otherwise.
+// The passphrase of a store which does not exist yet is asked twice.
+func (s *encryptedFileStore) secret() ([]byte, error) {
+	if s.passphrase != nil {
+		return s.passphrase, nil
+	}
+
+	if s.KeyFile != "" {
+		secret, err := readKeyFile(ExpandHome(s.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		s.passphrase = secret
+		return secret, nil
+	}
+
+	secret, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", s.Path))
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("[encryptedFileStore] Empty passphrase for %s", s.Path)
+	}
+	// a typo in the passphrase of a new store would lock the user out of it
+	if _, err := os.Stat(ExpandHome(s.Path)); errors.Is(err, os.ErrNotExist) {
+		confirm, err := readPassphrase(fmt.Sprintf("Confirm passphrase for %s: ", s.Path))
+		if err != nil {
+			return nil, err
+		}
+		if string(confirm) != string(secret) {
+			return nil, fmt.Errorf("[encryptedFileStore] Passphrases for %s do not match", s.Path)
+		}
+	}
+	s.passphrase = secret
+	return secret, nil
+}
+
+// readKeyFile reads a key file, refusing it when it is accessible by other users.
+func readKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("[readKeyFile] Permissions %#o for %s are too open, it must not be accessible by others", info.Mode().Perm(), path)
+	}
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("[readKeyFile] %s is empty", path)
+	}
+	return key, nil
+}
+
+// readPassphrase prompts for a passphrase on the controlling terminal, since stdin and stdout
+// are used by git to talk to the remote helper.
+func readPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile(TTYPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("[readPassphrase] Could not open %s, consider setting iap.tokenStoreKeyFile: %w", TTYPath, err)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	defer fmt.Fprintln(tty)
+
+	if term.IsTerminal(int(tty.Fd())) {
+		return term.ReadPassword(int(tty.Fd()))
+	}
+
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(line)), nil
+}
@@ -0,0 +1,200 @@
+package iap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestEncryptedStore(t *testing.T, dir string) *encryptedFileStore {
+	t.Helper()
+	keyFile := filepath.Join(dir, "tokens.key")
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(keyFile, []byte("correct horse battery staple\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &encryptedFileStore{Path: filepath.Join(dir, "tokens.enc"), KeyFile: keyFile}
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestEncryptedStore(t, dir)
+
+	if _, err := store.Get("helper", "default"); err == nil {
+		t.Fatal("Get on an empty store should fail")
+	}
+	if err := store.Store("helper", "default", "token-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store("helper", "work", "token-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new instance decrypts what the first one saved
+	other := newTestEncryptedStore(t, dir)
+	for account, want := range map[string]string{"default": "token-a", "work": "token-b"} {
+		got, err := other.Get("helper", account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Get(helper, %s) = %q, want %q", account, got, want)
+		}
+	}
+
+	if err := other.Erase("helper", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("helper", "default"); err == nil {
+		t.Error("Get after Erase should fail")
+	}
+	if err := store.Erase("helper", "missing"); err != nil {
+		t.Errorf("Erase of a missing secret should succeed, got %s", err)
+	}
+}
+
+func TestEncryptedFileStoreWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	if err := newTestEncryptedStore(t, dir).Store("helper", "default", "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := filepath.Join(dir, "wrong.key")
+	if err := ioutil.WriteFile(wrong, []byte("wrong"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := &encryptedFileStore{Path: filepath.Join(dir, "tokens.enc"), KeyFile: wrong}
+	if _, err := store.Get("helper", "default"); err == nil {
+		t.Fatal("Get with the wrong key should fail")
+	}
+
+	// the wrong key is not kept: the next access reads the key again
+	if err := ioutil.WriteFile(wrong, []byte("correct horse battery staple\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get("helper", "default"); err != nil || got != "token" {
+		t.Errorf("Get with the right key after the wrong one = %q, %v, want the secret", got, err)
+	}
+}
+
+func TestEncryptedFileStoreConcurrentUpdates(t *testing.T) {
+	dir := t.TempDir()
+
+	// separate instances stand for separate processes, which only share the file lock
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := newTestEncryptedStore(t, dir)
+			if err := store.Store("helper", fmt.Sprintf("account-%d", i), fmt.Sprintf("token-%d", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	store := newTestEncryptedStore(t, dir)
+	for i := 0; i < 8; i++ {
+		got, err := store.Get("helper", fmt.Sprintf("account-%d", i))
+		if err != nil {
+			t.Fatalf("update of account-%d was lost: %s", i, err)
+		}
+		if want := fmt.Sprintf("token-%d", i); got != want {
+			t.Errorf("Get(helper, account-%d) = %q, want %q", i, got, want)
+		}
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(leftovers) > 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
+
+func TestEncryptedFileStorePeek(t *testing.T) {
+	dir := t.TempDir()
+	fallback := newTestEncryptedStore(t, dir)
+	fallback.Path = filepath.Join(dir, "fallback.enc")
+	if err := fallback.Store("helper", "default", "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newTestEncryptedStore(t, dir)
+	store.Fallback = fallback
+	if got, err := store.Peek("helper", "default"); err != nil || got != "token" {
+		t.Fatalf("Peek(helper, default) = %q, %v, want the secret of the fallback", got, err)
+	}
+	if _, err := fallback.Get("helper", "default"); err != nil {
+		t.Error("Peek migrated the secret out of the fallback")
+	}
+	if _, err := os.Stat(store.Path); !os.IsNotExist(err) {
+		t.Errorf("Peek wrote %s", store.Path)
+	}
+	if _, err := store.Peek("helper", "missing"); err == nil {
+		t.Error("Peek of a missing secret should fail")
+	}
+}
+
+// memoryStore is a TokenStore held in memory, standing in for git-credential-store.
+type memoryStore struct {
+	entries  secrets
+	eraseErr error
+}
+
+func (m *memoryStore) Get(host, account string) (string, error) {
+	if v, ok := m.entries[host][account]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("not found for host=%s,account=%s", host, account)
+}
+
+func (m *memoryStore) Store(host, account, secret string) error {
+	m.entries.set(host, account, secret)
+	return nil
+}
+
+func (m *memoryStore) Erase(host, account string) error {
+	if m.eraseErr != nil {
+		return m.eraseErr
+	}
+	delete(m.entries[host], account)
+	return nil
+}
+
+func TestEncryptedFileStoreMigration(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		eraseErr  error
+		wantErase bool
+	}{
+		{"erased", nil, true},
+		{"erase fails", fmt.Errorf("read-only"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fallback := &memoryStore{entries: secrets{"helper": {"default": "token"}}, eraseErr: tc.eraseErr}
+			store := newTestEncryptedStore(t, dir)
+			store.Fallback = fallback
+
+			// a failed erase is only a warning: the secret is migrated anyway
+			if got, err := store.Get("helper", "default"); err != nil || got != "token" {
+				t.Fatalf("Get(helper, default) = %q, %v, want the secret of the fallback", got, err)
+			}
+			if _, err := fallback.Get("helper", "default"); (err != nil) != tc.wantErase {
+				t.Errorf("secret erased from the fallback: %t, want %t", err != nil, tc.wantErase)
+			}
+
+			// the secret now lives in the encrypted file
+			if got, err := newTestEncryptedStore(t, dir).Get("helper", "default"); err != nil || got != "token" {
+				t.Errorf("Get(helper, default) from the file = %q, %v, want the migrated secret", got, err)
+			}
+			if _, err := store.Get("helper", "missing"); err == nil {
+				t.Error("Get of a secret missing from both stores should fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package iap
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// keyringKeyType is the kernel key type used to hold secrets.
+	keyringKeyType = "user"
+
+	// keyringKeyPerm grants every permission to the possessor and the owner, and none to anyone else.
+	keyringKeyPerm = 0x3f3f0000
+)
+
+// keyringStore holds secrets in the Linux kernel keyring, where they expire after a timeout.
+type keyringStore struct {
+	ringID  int
+	timeout time.Duration
+}
+
+func newKeyringStore(keyring string, timeout time.Duration) (TokenStore, error) {
+	var ringID int
+	switch keyring {
+	case "", "user":
+		ringID = unix.KEY_SPEC_USER_KEYRING
+	case "session":
+		ringID = unix.KEY_SPEC_SESSION_KEYRING
+	default:
+		return nil, fmt.Errorf("[newKeyringStore] Unknown iap.keyring '%s', expected 'user' or 'session'", keyring)
+	}
+	return &keyringStore{ringID: ringID, timeout: timeout}, nil
+}
+
+func keyringDescription(host, account string) string {
+	return fmt.Sprintf("git-iap:%s:%s", account, host)
+}
+
+func (s *keyringStore) Get(host, account string) (string, error) {
+	id, err := unix.KeyctlSearch(s.ringID, keyringKeyType, keyringDescription(host, account), 0)
+	if err != nil {
+		return "", fmt.Errorf("[keyringStore.Get] Not found for host=%s,account=%s: %w", host, account, err)
+	}
+
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return "", fmt.Errorf("[keyringStore.Get] Could not read key %d: %w", id, err)
+	}
+	buf := make([]byte, size)
+	if _, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0); err != nil {
+		return "", fmt.Errorf("[keyringStore.Get] Could not read key %d: %w", id, err)
+	}
+
+	log.Debug().Msgf("[keyringStore.Get] Found secret for host=%s,account=%s", host, account)
+	return string(buf), nil
+}
+
+func (s *keyringStore) Store(host, account, secret string) error {
+	return s.StoreUntil(host, account, secret, time.Now().Add(s.timeout))
+}
+
+// StoreUntil adds a secret to the keyring, which the kernel will expire at the given time.
+func (s *keyringStore) StoreUntil(host, account, secret string, exp time.Time) error {
+	timeout := int(time.Until(exp).Round(time.Second) / time.Second)
+	if timeout <= 0 {
+		return fmt.Errorf("[keyringStore.StoreUntil] Secret for host=%s,account=%s already expired", host, account)
+	}
+
+	id, err := unix.AddKey(keyringKeyType, keyringDescription(host, account), []byte(secret), s.ringID)
+	if err != nil {
+		return fmt.Errorf("[keyringStore.StoreUntil] Could not add key for host=%s,account=%s: %w", host, account, err)
+	}
+	if err := unix.KeyctlSetperm(id, keyringKeyPerm); err != nil {
+		return fmt.Errorf("[keyringStore.StoreUntil] Could not restrict permissions of key %d: %w", id, err)
+	}
+	if _, err := unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, timeout, 0, 0); err != nil {
+		return fmt.Errorf("[keyringStore.StoreUntil] Could not set timeout of key %d: %w", id, err)
+	}
+
+	log.Debug().Msgf("[keyringStore.StoreUntil] Secret saved for host=%s,account=%s until %s", host, account, exp)
+	return nil
+}
+
+func (s *keyringStore) Erase(host, account string) error {
+	id, err := unix.KeyctlSearch(s.ringID, keyringKeyType, keyringDescription(host, account), 0)
+	if err != nil {
+		return fmt.Errorf("[keyringStore.Erase] Not found for host=%s,account=%s: %w", host, account, err)
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id, s.ringID, 0, 0)
+	return err
+}
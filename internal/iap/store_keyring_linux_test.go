@@ -0,0 +1,109 @@
+package iap
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestKeyringStore returns a keyringStore holding its secrets in a new session keyring,
+// so that tests neither see nor leave secrets in the keyrings of the user.
+// The session keyring belongs to the thread of the test, which is locked and discarded at the end of the test.
+func newTestKeyringStore(t *testing.T, timeout time.Duration) *keyringStore {
+	t.Helper()
+	runtime.LockOSThread()
+
+	ringID, err := unix.KeyctlJoinSessionKeyring("git-iap-test")
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		t.Skipf("keyctl is not available: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("Could not create a session keyring: %s", err)
+	}
+	return &keyringStore{ringID: ringID, timeout: timeout}
+}
+
+func TestKeyringStore(t *testing.T) {
+	store := newTestKeyringStore(t, time.Hour)
+
+	if _, err := store.Get("helper", "default"); err == nil {
+		t.Fatal("Get on an empty keyring should fail")
+	}
+	if err := store.Store("helper", "default", "token-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Store("helper", "work", "token-b"); err != nil {
+		t.Fatal(err)
+	}
+	for account, want := range map[string]string{"default": "token-a", "work": "token-b"} {
+		got, err := store.Get("helper", account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Get(helper, %s) = %q, want %q", account, got, want)
+		}
+	}
+
+	// storing again replaces the secret
+	if err := store.Store("helper", "default", "token-c"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get("helper", "default"); got != "token-c" {
+		t.Errorf("Get after a second Store = %q, want %q", got, "token-c")
+	}
+
+	if err := store.Erase("helper", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("helper", "default"); err == nil {
+		t.Error("Get after Erase should fail")
+	}
+	if err := store.Erase("helper", "default"); err == nil {
+		t.Error("Erase of a missing secret should fail")
+	}
+}
+
+func TestKeyringStoreTimeout(t *testing.T) {
+	store := newTestKeyringStore(t, time.Second)
+
+	if err := store.Store("helper", "default", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreUntil("audience", IDTokenAccount, "id-token", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("helper", "default"); err != nil {
+		t.Fatalf("Get before the timeout: %s", err)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+	if _, err := store.Get("helper", "default"); err == nil {
+		t.Error("Get after the timeout should fail")
+	}
+	if _, err := store.Get("audience", IDTokenAccount); err != nil {
+		t.Errorf("StoreUntil should not expire with the timeout of the store: %s", err)
+	}
+
+	if err := store.StoreUntil("audience", IDTokenAccount, "id-token", time.Now().Add(-time.Minute)); err == nil {
+		t.Error("StoreUntil should refuse a secret that already expired")
+	}
+}
+
+func TestNewKeyringStore(t *testing.T) {
+	for keyring, want := range map[string]int{"": unix.KEY_SPEC_USER_KEYRING, "user": unix.KEY_SPEC_USER_KEYRING, "session": unix.KEY_SPEC_SESSION_KEYRING} {
+		store, err := newKeyringStore(keyring, time.Hour)
+		if err != nil {
+			t.Fatalf("newKeyringStore(%q): %s", keyring, err)
+		}
+		if got := store.(*keyringStore).ringID; got != want {
+			t.Errorf("newKeyringStore(%q) uses keyring %d, want %d", keyring, got, want)
+		}
+	}
+	if _, err := newKeyringStore("process", time.Hour); err == nil {
+		t.Error("newKeyringStore should refuse unknown keyrings")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package iap
+
+import (
+	"fmt"
+	"time"
+)
+
+func newKeyringStore(keyring string, timeout time.Duration) (TokenStore, error) {
+	return nil, fmt.Errorf("[newKeyringStore] iap.tokenStore '%s' is only supported on Linux", TokenStoreKernelKeyring)
+}
@@ -2,18 +2,13 @@ package iap
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"net/http"
 	"net/url"
 
+	"github.com/adohkan/git-remote-https-iap/iapauth"
 	"github.com/adohkan/git-remote-https-iap/internal/git"
-	"github.com/int128/oauth2cli"
-	"github.com/pkg/browser"
-	"github.com/rs/zerolog/log"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -23,141 +18,123 @@ const (
 
 	// CacheUsername is the username used when saving the refresh-token in git-credential-store.
 	// It can be an arbitrary value.
+	// Refresh-tokens are now cached per helperID and account, this is only used to migrate
+	// refresh-tokens that were cached per domain.
 	CacheUsername = "refresh-token"
+
+	// DefaultAccount is the account used to cache tokens when 'iap.account' is not set.
+	DefaultAccount = "default"
 )
 
-type token struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
-	Scope       string `json:"scope"`
-	TokenType   string `json:"token_type"`
-	IDToken     string `json:"id_token"`
+// Account returns the account used to cache tokens for a given domain.
+// A single refresh-token per helperID and account covers every host using that helper.
+func Account(domain string) string {
+	account, err := LookupAccount(domain)
+	if err != nil {
+		log.Fatal().Msgf("[Account] %s", err)
+	}
+	return account
 }
 
-type httpError struct {
-	Error     string `json:"error"`
-	ErrorDesc string `json:"error_description"`
+// LookupAccount is similar to Account, but returns an error instead of exiting when the config cannot be read.
+func LookupAccount(domain string) (string, error) {
+	account, ok, err := git.ConfigURLMatch("iap.account", domain)
+	if err != nil {
+		return "", err
+	}
+	if !ok || account == "" {
+		return DefaultAccount, nil
+	}
+	return account, nil
 }
 
-// getRefreshTokenFromBrowserFlow initialize an OAuth login workflow via the browser and returns a refresh token valid for a given url
-// see: https://github.com/int128/oauth2cli/blob/master/example/main.go
-func getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret string) (string, error) {
-	ctx := context.Background()
-	ready := make(chan string, 1)
-
-	var eg errgroup.Group
-	var token *oauth2.Token
-	var err error
-
-	var OAuthConfig = oauth2.Config{
-		ClientID:     helperID,
-		ClientSecret: helperSecret,
-		Endpoint:     google.Endpoint,
-		Scopes:       []string{"openid", "email"},
+// TokenKey identifies the IAP auth tokens of a given domain: domains with the same audience and account
+// share the same tokens.
+func TokenKey(domain string) (string, error) {
+	clientID, err := lookupConfig("iap.clientID", domain)
+	if err != nil {
+		return "", err
 	}
-
-	eg.Go(func() error {
-		select {
-		case url, ok := <-ready:
-			if !ok {
-				return nil
-			}
-			log.Debug().Msgf("[getRefreshTokenFromBrowserFlow] Open %s", url)
-			if err := browser.OpenURL(url); err != nil {
-				log.Error().Msgf("[getRefreshTokenFromBrowserFlow] Could not open the browser: %s", err)
-			}
-			return nil
-		case err := <-ctx.Done():
-			return fmt.Errorf("[getRefreshTokenFromBrowserFlow] Context done while waiting for authorization: %w", err)
-		}
-	})
-
-	eg.Go(func() error {
-		defer close(ready)
-
-		cfg := oauth2cli.Config{
-			OAuth2Config:         OAuthConfig,
-			LocalServerReadyChan: ready,
-		}
-
-		token, err = oauth2cli.GetToken(ctx, cfg)
-		if err != nil {
-			return fmt.Errorf("[getRefreshTokenFromBrowserFlow] Could not get 'access_token' for the desktop-app: %w", err)
-		}
-
-		return nil
-	})
-
-	err = eg.Wait()
+	account, err := LookupAccount(domain)
 	if err != nil {
 		return "", err
 	}
-
-	log.Debug().Msgf("[getRefreshTokenFromBrowserFlow] refreshToken: %s", token.RefreshToken)
-	return token.RefreshToken, nil
-}
-
-func cacheRefreshToken(key, token string) error {
-	return git.StoreCredentials(CacheProtocol, key, CacheUsername, token)
+	return fmt.Sprintf("%s/%s", clientID, account), nil
 }
 
-func getRefreshTokenFromCache(key string) (string, error) {
-	return git.GetCredentials(CacheProtocol, key, CacheUsername)
+func cacheRefreshToken(store TokenStore, helperID, account, token string) error {
+	return store.Store(helperID, account, token)
 }
 
-// GetIAPAuthToken take care of the IAP Authentication process when relevant.
-// It optmize this workflow by detecting cases where an existing IAP auth token is already available,
-// and caching a refresh-token.
-// It returns a raw IAP auth token and any error encountered.
-func GetIAPAuthToken(domain, helperID, helperSecret, IAPclientID string, forcebrowserflow bool) (string, error) {
-	var result token
-	var errorMesg httpError
-
-	refreshToken, err := getRefreshTokenFromCache(domain)
-
-	if forcebrowserflow {
-		log.Debug().Msgf("[GetIAPAuthToken] Forcing getRefreshTokenFromBrowserFlow")
-		refreshToken, err = getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret)
+func getRefreshTokenFromCache(store TokenStore, helperID, account, domain string) (string, error) {
+	token, err := store.Get(helperID, account)
+	if err == nil {
+		return token, nil
 	}
 
-	if err != nil {
-		log.Debug().Msgf("[GetIAPAuthToken] No cached refresh token for %s: %s", domain, err.Error())
+	// refresh-tokens used to be cached per base domain
+	u, parseErr := url.Parse(domain)
+	if parseErr != nil {
+		return "", err
+	}
+	legacy, legacyErr := store.Get(fmt.Sprintf("%s://%s", u.Scheme, u.Host), CacheUsername)
+	if legacyErr != nil {
+		return "", err
+	}
+	log.Debug().Msgf("[getRefreshTokenFromCache] Migrating refresh token of %s to helperID=%s,account=%s", domain, helperID, account)
+	if err := cacheRefreshToken(store, helperID, account, legacy); err != nil {
+		log.Warn().Msgf("[getRefreshTokenFromCache] Could not migrate refresh token of %s: %s", domain, err.Error())
+	}
+	return legacy, nil
+}
 
-		refreshToken, err = getRefreshTokenFromBrowserFlow(domain, helperID, helperSecret)
-		if err != nil {
-			log.Debug().Msgf("[GetIAPAuthToken] getRefreshTokenFromBrowserFlow Failed")
-			return "", err
-		}
-		if err := cacheRefreshToken(domain, refreshToken); err != nil {
-			log.Warn().Msgf("[GetIAPAuthToken] Could not cache refresh token for %s: %s", domain, err.Error())
-		}
+// RevokeRefreshToken revokes the refresh-token cached in store for a helperID and account,
+// and removes it from store, along with the one cached per host for domain by older versions.
+// The refresh-token is removed even if it could not be revoked.
+func RevokeRefreshToken(store TokenStore, domain, helperID, account string) error {
+	if u, err := url.Parse(domain); err == nil {
+		_ = store.Erase(fmt.Sprintf("%s://%s", u.Scheme, u.Host), CacheUsername)
 	}
-	log.Debug().Msgf("[GetIAPAuthToken] refreshToken is: %s", refreshToken)
-
-	// exchange our refreshToken for an id_token that we can use as GCP_IAAP_AUTH_TOKEN
-	log.Debug().Msgf("[GetIAPAuthToken] Google Endpoint is: %s", google.Endpoint.TokenURL)
-	resp, err := http.PostForm(google.Endpoint.TokenURL, url.Values{
-		"client_id":     {helperID},
-		"client_secret": {helperSecret},
-		"refresh_token": {refreshToken},
-		"grant_type":    {"refresh_token"},
-		"audience":      {IAPclientID},
-	})
 
+	token, err := store.Get(helperID, account)
 	if err != nil {
-		return "", fmt.Errorf("[GetIAPAuthToken] Could not get exchange 'refresh_token' for IAP Auth Token: %s", err.Error())
+		return fmt.Errorf("[RevokeRefreshToken] No refresh token cached for helperID=%s,account=%s: %w", helperID, account, err)
 	}
-
-	if resp.StatusCode != 200 {
-		json.NewDecoder(resp.Body).Decode(&errorMesg)
-		return "", fmt.Errorf("[GetIAPAuthToken] Could not get exchange 'refresh_token' for IAP Auth Token: HTTP Error Code: %s .... Error Description: %s", errorMesg.ErrorDesc, errorMesg.Error)
+	revokeErr := iapauth.Revoke(context.Background(), nil, token)
+	if err := store.Erase(helperID, account); err != nil {
+		return err
 	}
+	return revokeErr
+}
 
-	log.Debug().Msgf("[GetIAPAuthToken] Successfully used 'refresh_token' to claim IAP Auth Token")
+// gitCredentials is an iapauth.CredentialSource returning the refresh-token cached in the TokenStore,
+// and running the browser flow when there is none, or when forcebrowserflow is set.
+type gitCredentials struct {
+	domain           string
+	account          string
+	store            TokenStore
+	forcebrowserflow bool
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("[GetIAPAuthToken] Could not get exchange 'refresh_token' for IAP Auth Token: %s", err.Error())
+func (c *gitCredentials) RefreshToken(ctx context.Context, client *oauth2.Config) (string, error) {
+	if !c.forcebrowserflow {
+		refreshToken, err := getRefreshTokenFromCache(c.store, client.ClientID, c.account, c.domain)
+		if err == nil {
+			log.Debug().Msgf("[gitCredentials] Found cached refresh token for %s", c.domain)
+			return refreshToken, nil
+		}
+		log.Debug().Msgf("[gitCredentials] No cached refresh token for %s: %s", c.domain, err.Error())
+	} else {
+		log.Debug().Msgf("[gitCredentials] Forcing browser flow")
 	}
 
-	return result.IDToken, nil
+	refreshToken, err := (&iapauth.BrowserFlow{}).RefreshToken(ctx, client)
+	if err != nil {
+		log.Debug().Msgf("[gitCredentials] Browser flow failed")
+		return "", err
+	}
+	if err := cacheRefreshToken(c.store, client.ClientID, c.account, refreshToken); err != nil {
+		log.Warn().Msgf("[gitCredentials] Could not cache refresh token for %s: %s", c.domain, err.Error())
+	}
+	return refreshToken, nil
 }
@@ -0,0 +1,39 @@
+// Package iaptest provides fixtures shared by the tests of iapauth and of the packages built on it.
+package iaptest
+
+import (
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// A RotatingSource is an iapauth.Invalidator handing out "token-1", then "token-2" once the first one
+// has been invalidated. It is safe for concurrent use.
+type RotatingSource struct {
+	mu          sync.Mutex
+	invalidated int
+}
+
+// Token implements oauth2.TokenSource.
+func (s *RotatingSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.invalidated > 0 {
+		return &oauth2.Token{AccessToken: "token-2"}, nil
+	}
+	return &oauth2.Token{AccessToken: "token-1"}, nil
+}
+
+// Invalidate implements iapauth.Invalidator.
+func (s *RotatingSource) Invalidate(*oauth2.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalidated++
+}
+
+// Invalidated returns how many times a token was invalidated.
+func (s *RotatingSource) Invalidated() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.invalidated
+}
@@ -0,0 +1,27 @@
+// Package log is the logger of the internal packages. It is disabled unless the program sets Logger,
+// so that programs built on gogit or iapauth do not get the logs of the helper.
+package log
+
+import "github.com/rs/zerolog"
+
+// Logger is used by the internal packages. It is disabled by default.
+var Logger = zerolog.Nop()
+
+// Trace starts a new message with trace level.
+func Trace() *zerolog.Event { return Logger.Trace() }
+
+// Debug starts a new message with debug level.
+func Debug() *zerolog.Event { return Logger.Debug() }
+
+// Info starts a new message with info level.
+func Info() *zerolog.Event { return Logger.Info() }
+
+// Warn starts a new message with warn level.
+func Warn() *zerolog.Event { return Logger.Warn() }
+
+// Error starts a new message with error level.
+func Error() *zerolog.Event { return Logger.Error() }
+
+// Fatal starts a new message with fatal level. The program exits once the message is sent,
+// even when Logger is disabled.
+func Fatal() *zerolog.Event { return Logger.Fatal() }
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+)
+
+// directTransport makes requests without going through the proxy set in the environment,
+// which may be the ForwardProxy itself.
+var directTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	return t
+}()
+
+// A ForwardProxy is an HTTP proxy handling CONNECT requests.
+// TLS connections to IAP hosts are terminated with certificates issued by CA, and their requests
+// are forwarded with the IAP auth token of their URL. Any other traffic is passed through untouched.
+type ForwardProxy struct {
+	CA *CA
+	// IsIAPHost is given the host, and its port unless it is 443. It accepts the hosts with some of their paths
+	// configured for IAP.
+	IsIAPHost func(host string) bool
+
+	scopesOnce sync.Once
+	scopes     []string
+
+	mu         sync.Mutex
+	audiences  map[string]string
+	forwarders map[string]*Forwarder
+}
+
+// NewForwardProxy returns a ForwardProxy adding IAP auth for the hosts accepted by isIAPHost.
+func NewForwardProxy(ca *CA, isIAPHost func(host string) bool) *ForwardProxy {
+	return &ForwardProxy{
+		CA:         ca,
+		IsIAPHost:  isIAPHost,
+		audiences:  map[string]string{},
+		forwarders: map[string]*Forwarder{},
+	}
+}
+
+// Serve accepts connections on l and proxies their requests, until l is closed.
+func (p *ForwardProxy) Serve(l net.Listener) error {
+	return (&http.Server{Handler: p}).Serve(l)
+}
+
+func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		p.passThruHTTP(w, r)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Error().Msgf("[ForwardProxy] Could not hijack CONNECT %s: %s", r.Host, err)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "443"
+	}
+	target := &url.URL{Scheme: "https", Host: r.Host}
+	if port == "443" {
+		target.Host = host
+	}
+	if !p.IsIAPHost(target.Host) {
+		log.Debug().Msgf("[ForwardProxy] Tunnel %s", r.Host)
+		p.tunnel(conn, net.JoinHostPort(host, port))
+		return
+	}
+
+	log.Debug().Msgf("[ForwardProxy] Terminate TLS for %s", r.Host)
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.CA.Certificate(host)
+		},
+	})
+	// the connection is served in its own goroutine, Serve returns right after accepting it
+	(&http.Server{Handler: p.handler(target)}).Serve(&singleConnListener{conn: tlsConn})
+}
+
+// handler forwards the requests made to an IAP host. IAP config is resolved against the URL of each request,
+// as paths of a host may be configured with their own clientID.
+func (p *ForwardProxy) handler(target *url.URL) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := *target
+		u.Path = r.URL.Path
+		f, err := p.forwarder(target, u.String())
+		if err != nil {
+			log.Error().Msgf("[ForwardProxy] %s %s: %s", r.Method, u.String(), err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		f.ServeHTTP(w, r)
+	})
+}
+
+// forwarder returns the Forwarder of the requests to a URL of target. URLs sharing the same audience
+// and account share the same Forwarder. URLs that are not configured for IAP are passed through untouched.
+func (p *ForwardProxy) forwarder(target *url.URL, u string) (*Forwarder, error) {
+	// reading the config forks git several times: it is only done once per host and set of matching
+	// config entries, without holding the lock
+	scope := fmt.Sprintf("%s %s", target.Host, p.scope(u))
+	p.mu.Lock()
+	key, ok := p.audiences[scope]
+	p.mu.Unlock()
+	if !ok {
+		if err := iap.CheckConfig(u); err == nil {
+			if key, err = iap.TokenKey(u); err != nil {
+				return nil, err
+			}
+		}
+		p.mu.Lock()
+		p.audiences[scope] = key
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id := fmt.Sprintf("%s %s", target.Host, key)
+	f, ok := p.forwarders[id]
+	if !ok {
+		if key == "" {
+			f = &Forwarder{Target: target, Client: &http.Client{
+				Transport: directTransport,
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}}
+		} else {
+			tokens := NewTokenSource(u, nil)
+			f = NewForwarder(target, tokens)
+			f.Client.Transport = &iapauth.Transport{Source: tokens, Base: directTransport}
+		}
+		p.forwarders[id] = f
+	}
+	return f, nil
+}
+
+// scope returns the URLs of the IAP config entries that apply to u. URLs of the same host with the same
+// entries resolve to the same config.
+func (p *ForwardProxy) scope(u string) string {
+	p.scopesOnce.Do(func() {
+		seen := map[string]bool{}
+		for _, c := range git.ConfigGetRegexp(`^(iap\..*|http\..*\.cookiefile)$`) {
+			if !seen[c.Url] {
+				seen[c.Url] = true
+				p.scopes = append(p.scopes, c.Url)
+			}
+		}
+	})
+
+	var matched []string
+	for _, s := range p.scopes {
+		if git.MatchURL(s, u) {
+			matched = append(matched, s)
+		}
+	}
+	return strings.Join(matched, " ")
+}
+
+func (p *ForwardProxy) tunnel(client net.Conn, addr string) {
+	upstream, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		log.Error().Msgf("[ForwardProxy] Could not connect to %s: %s", addr, err)
+		client.Close()
+		return
+	}
+
+	go func() {
+		io.Copy(upstream, client)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+// passThruHTTP proxies plain http:// requests untouched.
+func (p *ForwardProxy) passThruHTTP(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() {
+		http.Error(w, fmt.Sprintf("%s is a proxy, not a server", r.Host), http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	resp, err := directTransport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// singleConnListener is a net.Listener that accepts a single, already established, connection.
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var c net.Conn
+	l.once.Do(func() { c = l.conn })
+	if c == nil {
+		return nil, io.EOF
+	}
+	return c, nil
+}
+
+func (l *singleConnListener) Close() error   { return nil }
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
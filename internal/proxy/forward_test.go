@@ -0,0 +1,31 @@
+package proxy
+
+import "testing"
+
+func TestForwardProxyScope(t *testing.T) {
+	p := &ForwardProxy{scopes: []string{
+		"https://git.example.com",
+		"https://git.example.com/group",
+		"https://*.example.com",
+		"https://*.example.com/team",
+		"https://git.example.com:8443/repo.git",
+	}}
+	p.scopesOnce.Do(func() {})
+
+	for u, want := range map[string]string{
+		"https://git.example.com/repo.git/info/refs":       "https://git.example.com https://*.example.com",
+		"https://git.example.com/group/repo.git/info/refs": "https://git.example.com https://git.example.com/group https://*.example.com",
+		"https://git.example.com/groupie/repo.git":         "https://git.example.com https://*.example.com",
+		"https://GIT.example.com/group/objects/ab/cdef":    "https://git.example.com https://git.example.com/group https://*.example.com",
+		"https://other.example.com/repo.git":               "https://*.example.com",
+		"https://other.example.com/team/repo.git":          "https://*.example.com https://*.example.com/team",
+		"https://git.example.com:8443/repo.git/info/refs":  "https://git.example.com:8443/repo.git",
+		"https://git.example.com:8443/other.git":           "",
+		"https://a.b.example.com/repo.git":                 "",
+		"https://example.org/repo.git":                     "",
+	} {
+		if got := p.scope(u); got != want {
+			t.Errorf("scope(%s) = %q, want %q", u, got, want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+)
+
+// hopHeaders are removed when forwarding requests and responses.
+// see: https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// A Forwarder is an http.Handler that forwards requests to an IAP protected URL,
+// using a Client that injects an IAP auth token, like the one returned by iapauth.NewClient.
+type Forwarder struct {
+	Target *url.URL
+	Client *http.Client
+}
+
+// NewForwarder returns a Forwarder for an IAP protected URL, injecting tokens that are refreshed
+// ahead of their expiry. Requests bounced by IAP are retried once with a new token.
+// Redirects are handled by the client of the forwarder.
+func NewForwarder(target *url.URL, tokens *TokenSource) *Forwarder {
+	return &Forwarder{
+		Target: target,
+		Client: iapauth.NewClient(tokens),
+	}
+}
+
+// Serve accepts connections on l and forwards their requests, until l is closed.
+func (f *Forwarder) Serve(l net.Listener) error {
+	return (&http.Server{Handler: f}).Serve(l)
+}
+
+func (f *Forwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	out, err := f.outgoing(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := f.Client.Do(out)
+	if err != nil {
+		log.Error().Msgf("[Forwarder] %s %s: %s", r.Method, r.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	f.rewriteLocation(r, resp.Header)
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (f *Forwarder) outgoing(r *http.Request) (*http.Request, error) {
+	u := *f.Target
+	u.Path = singleJoiningSlash(f.Target.Path, r.URL.Path)
+	u.RawQuery = r.URL.RawQuery
+
+	body, err := replayableBody(r)
+	if err != nil {
+		return nil, err
+	}
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if out.GetBody == nil {
+		out.ContentLength = r.ContentLength
+	}
+	for k, v := range r.Header {
+		out.Header[k] = v
+	}
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	return out, nil
+}
+
+// replayableBody returns the body of r in memory when it is at most iapauth.MaxReplayBody long,
+// so that http.NewRequest sets GetBody. Larger bodies are streamed.
+func replayableBody(r *http.Request) (io.Reader, error) {
+	if r.ContentLength > iapauth.MaxReplayBody {
+		return r.Body, nil
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(r.Body, iapauth.MaxReplayBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(head) > iapauth.MaxReplayBody {
+		return io.MultiReader(bytes.NewReader(head), r.Body), nil
+	}
+	return bytes.NewReader(head), nil
+}
+
+// rewriteLocation makes redirects to the Target point at the forwarder, so that clients keep using it.
+func (f *Forwarder) rewriteLocation(r *http.Request, h http.Header) {
+	loc, err := url.Parse(h.Get("Location"))
+	if err != nil || loc.Path == "" {
+		return
+	}
+	upstream := loc.Host == f.Target.Host && loc.Scheme == f.Target.Scheme
+	if !upstream && (loc.Host != "" || !strings.HasPrefix(loc.Path, "/")) {
+		return
+	}
+	base := strings.TrimSuffix(f.Target.Path, "/")
+	if loc.Path != base && !strings.HasPrefix(loc.Path, base+"/") {
+		return
+	}
+
+	loc.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(loc.Path, base), "/")
+	loc.RawPath = ""
+	if upstream {
+		loc.Scheme, loc.Host = "http", r.Host
+		if r.TLS != nil {
+			loc.Scheme = "https"
+		}
+	}
+	h.Set("Location", loc.String())
+}
+
+func singleJoiningSlash(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		return a + b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/iaptest"
+)
+
+// A testForwarder is a Forwarder to the /base path of an upstream, which records the length
+// of the bodies it receives and answers 401 to requests carrying "token-1".
+type testForwarder struct {
+	URL      string
+	Upstream string
+	received []int
+}
+
+func newTestForwarder(t *testing.T, handler http.HandlerFunc) *testForwarder {
+	t.Helper()
+	tf := &testForwarder{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		tf.received = append(tf.received, len(body))
+		if r.Header.Get(iapauth.DefaultHeader) == "Bearer token-1" {
+			w.Header().Set(iapauth.GeneratedResponseHeader, "true")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+
+	target, _ := url.Parse(upstream.URL + "/base")
+	f := &Forwarder{Target: target, Client: iapauth.NewClient(&iaptest.RotatingSource{})}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	tf.URL, tf.Upstream = srv.URL, upstream.URL
+	return tf
+}
+
+func TestForwarderReplaysSmallBodies(t *testing.T) {
+	tf := newTestForwarder(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	resp, err := http.Post(tf.URL+"/repo.git/git-upload-pack", "application/x-git-upload-pack-request", strings.NewReader("0032want"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if len(tf.received) != 2 || tf.received[1] != len("0032want") {
+		t.Errorf("upstream received bodies of %v bytes, want the body twice", tf.received)
+	}
+}
+
+func TestForwarderStreamsLargeBodies(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		tf := newTestForwarder(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+
+		// IAP refuses the first token, and the request cannot be replayed; the next one uses a new token
+		for _, want := range []int{http.StatusUnauthorized, http.StatusOK} {
+			tf.received = nil
+			var body io.Reader = bytes.NewReader(make([]byte, iapauth.MaxReplayBody+1))
+			if chunked {
+				// hide the length, so that the body is sent chunked
+				body = io.MultiReader(body)
+			}
+			resp, err := http.Post(tf.URL+"/repo.git/git-receive-pack", "application/x-git-receive-pack-request", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != want {
+				t.Errorf("chunked=%v: status = %d, want %d", chunked, resp.StatusCode, want)
+			}
+			if len(tf.received) != 1 || tf.received[0] != iapauth.MaxReplayBody+1 {
+				t.Errorf("chunked=%v: upstream received bodies of %v bytes, want the whole body once", chunked, tf.received)
+			}
+		}
+	}
+}
+
+func TestForwarderRewritesLocation(t *testing.T) {
+	var tf *testForwarder
+	tf = newTestForwarder(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/base/absolute":
+			w.Header().Set("Location", tf.Upstream+"/base/repo.git/info/refs?service=git-upload-pack")
+		case "/base/relative":
+			w.Header().Set("Location", "/base/repo.git/")
+		default:
+			w.Header().Set("Location", "https://elsewhere.example/base/repo.git")
+		}
+		w.WriteHeader(http.StatusFound)
+	})
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for path, want := range map[string]string{
+		"/absolute": tf.URL + "/repo.git/info/refs?service=git-upload-pack",
+		"/relative": "/repo.git/",
+		"/other":    "https://elsewhere.example/base/repo.git",
+	} {
+		resp, err := client.Get(tf.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("Location for %s = %q, want %q", path, got, want)
+		}
+	}
+}
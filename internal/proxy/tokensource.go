@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/iap"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultRefreshAhead is how long before its expiry an IAP auth token gets replaced.
+	DefaultRefreshAhead = 5 * time.Minute
+
+	retryDelay = 30 * time.Second
+)
+
+// A TokenSource holds the IAP auth token of a URL, and mints a new one ahead of its expiry.
+// It is built on an iapauth.TokenSource, configured from the git config of the URL.
+// It is safe for concurrent use.
+type TokenSource struct {
+	URL          string
+	RefreshAhead time.Duration
+
+	mu      sync.Mutex
+	tokens  *iapauth.TokenSource
+	seed    *oauth2.Token
+	refresh bool
+	current *oauth2.Token
+}
+
+// NewTokenSource returns a TokenSource for a URL, starting with an existing IAP Cookie.
+// When cookie is nil, the IAP auth token cached for the audience of the URL is used, if any.
+func NewTokenSource(url string, cookie *iap.Cookie) *TokenSource {
+	s := &TokenSource{
+		URL:          url,
+		RefreshAhead: DefaultRefreshAhead,
+	}
+	if cookie != nil {
+		s.seed, _ = iapauth.ParseIDToken(cookie.Token.Raw)
+	}
+	return s
+}
+
+// Token returns an IAP auth token that is valid for at least RefreshAhead.
+// It implements oauth2.TokenSource, so that it can be used with an iapauth.Transport.
+func (s *TokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seed != nil && time.Now().Add(s.RefreshAhead).Before(s.seed.Expiry) {
+		s.current = s.seed
+		return s.seed, nil
+	}
+	s.seed = nil
+
+	if s.tokens == nil {
+		config, err := iap.NewConfig(s.URL, false)
+		if err != nil {
+			return nil, err
+		}
+		config.RefreshAhead = s.RefreshAhead
+		s.tokens = iapauth.NewTokenSource(context.Background(), config)
+	}
+
+	get := s.tokens.Token
+	if s.refresh {
+		// the refused token may still be in the cache of the audience
+		get = s.tokens.Refresh
+	}
+	token, err := get()
+	if err != nil {
+		return nil, err
+	}
+	s.refresh = false
+	s.current = token
+	return token, nil
+}
+
+// Cookie returns an IAP Cookie that is valid for at least RefreshAhead.
+func (s *TokenSource) Cookie() (*iap.Cookie, error) {
+	t, err := s.Token()
+	if err != nil {
+		return nil, err
+	}
+	return iap.CookieFromToken(s.URL, t.AccessToken)
+}
+
+// Invalidate drops a token that IAP refused, so that the next call to Token mints a new one.
+// It is a no-op if the token has already been replaced.
+func (s *TokenSource) Invalidate(token *oauth2.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.seed != nil && s.seed.AccessToken == token.AccessToken:
+		s.seed = nil
+		s.refresh = true
+	case s.tokens != nil:
+		s.tokens.Invalidate(token)
+	}
+}
+
+// KeepFresh refreshes the token in the background ahead of its expiry, until stop is closed,
+// so that callers of Token do not have to wait for it.
+func (s *TokenSource) KeepFresh(stop <-chan struct{}) {
+	for {
+		wait := time.Minute
+		s.mu.Lock()
+		if s.current != nil {
+			wait = time.Until(s.current.Expiry.Add(-s.RefreshAhead))
+		}
+		s.mu.Unlock()
+		if wait < retryDelay {
+			// don't hammer the token endpoint after a failed refresh
+			wait = retryDelay
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+			if _, err := s.Token(); err != nil {
+				log.Error().Msgf("[TokenSource.KeepFresh] Could not refresh IAP auth token for %s: %s", s.URL, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/internal/git"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+)
+
+// A Helper implements the git remote-helper protocol over smart HTTP, so that it owns every HTTP request.
+// Fetches use 'stateless-connect' (protocol v2) when the server supports it, and otherwise
+// 'fetch' through 'git fetch-pack --stateless-rpc'. Pushes use 'git send-pack --stateless-rpc'.
+// see: https://git-scm.com/docs/gitremote-helpers
+type Helper struct {
+	Remote string
+	URL    *url.URL
+	Client *http.Client
+
+	in   *bufio.Reader
+	out  io.Writer
+	opts options
+
+	// adverts keeps the advertisements listed by 'list', which fetch-pack and send-pack read again,
+	// in temporary files rather than in memory.
+	adverts map[string]*os.File
+}
+
+type options struct {
+	verbosity     int
+	progress      bool
+	depth         string
+	followTags    bool
+	thin          bool
+	dryRun        bool
+	cloning       bool
+	updateShallow bool
+	atomic        bool
+	pushOptions   []string
+}
+
+// NewHelper returns a Helper talking to git over stdin/stdout, and sending requests to an https:// URL with client.
+func NewHelper(remote string, u *url.URL, client *http.Client) *Helper {
+	return &Helper{
+		Remote:  remote,
+		URL:     u,
+		Client:  client,
+		in:      bufio.NewReader(os.Stdin),
+		out:     os.Stdout,
+		opts:    options{verbosity: 1, thin: true},
+		adverts: map[string]*os.File{},
+	}
+}
+
+// Close removes the temporary files of the Helper.
+func (h *Helper) Close() error {
+	for service, f := range h.adverts {
+		f.Close()
+		os.Remove(f.Name())
+		delete(h.adverts, service)
+	}
+	return nil
+}
+
+// Run processes commands from git until it closes stdin.
+func (h *Helper) Run() error {
+	for {
+		line, err := h.readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Debug().Msgf("[Helper.Run] < %s", line)
+
+		cmd, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+
+		switch cmd {
+		case "":
+			return nil
+		case "capabilities":
+			fmt.Fprint(h.out, "stateless-connect\nfetch\npush\noption\n\n")
+		case "option":
+			fmt.Fprintln(h.out, h.option(arg))
+		case "list":
+			err = h.list(arg == "for-push")
+		case "stateless-connect":
+			var connected bool
+			connected, err = h.statelessConnect(arg)
+			if connected {
+				return err
+			}
+		case "fetch":
+			err = h.fetch(arg)
+		case "push":
+			err = h.push(arg)
+		default:
+			err = fmt.Errorf("unknown command '%s'", line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (h *Helper) readLine() (string, error) {
+	line, err := h.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// readBatch reads the remaining lines of a batch of commands, until the terminating blank line.
+func (h *Helper) readBatch(cmd, first string) ([]string, error) {
+	args := []string{first}
+	for {
+		line, err := h.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return args, nil
+		}
+		if !strings.HasPrefix(line, cmd+" ") {
+			return nil, fmt.Errorf("unexpected '%s' in a batch of '%s'", line, cmd)
+		}
+		args = append(args, strings.TrimPrefix(line, cmd+" "))
+	}
+}
+
+func (h *Helper) option(arg string) string {
+	name, value := arg, ""
+	if i := strings.Index(arg, " "); i >= 0 {
+		name, value = arg[:i], arg[i+1:]
+	}
+
+	var err error
+	switch name {
+	case "verbosity":
+		h.opts.verbosity, err = strconv.Atoi(value)
+	case "progress":
+		h.opts.progress, err = strconv.ParseBool(value)
+	case "depth":
+		_, err = strconv.Atoi(value)
+		h.opts.depth = value
+	case "followtags":
+		h.opts.followTags, err = strconv.ParseBool(value)
+	case "thin":
+		h.opts.thin, err = strconv.ParseBool(value)
+	case "dry-run":
+		h.opts.dryRun, err = strconv.ParseBool(value)
+	case "cloning":
+		h.opts.cloning, err = strconv.ParseBool(value)
+	case "update-shallow":
+		h.opts.updateShallow, err = strconv.ParseBool(value)
+	case "atomic":
+		h.opts.atomic, err = strconv.ParseBool(value)
+	case "push-option":
+		h.opts.pushOptions = append(h.opts.pushOptions, value)
+	default:
+		return "unsupported"
+	}
+	if err != nil {
+		return fmt.Sprintf("error invalid value '%s' for option %s", value, name)
+	}
+	return "ok"
+}
+
+// list prints the refs of the remote, as advertised by protocol v0.
+func (h *Helper) list(forPush bool) error {
+	service := uploadPack
+	if forPush {
+		service = receivePack
+	}
+
+	advert, _, err := h.discover(service, false)
+	if err != nil {
+		return err
+	}
+	defer advert.Close()
+
+	spool, err := ioutil.TempFile("", "git-remote-https+iap-advert-")
+	if err != nil {
+		return err
+	}
+	if old, ok := h.adverts[service]; ok {
+		old.Close()
+		os.Remove(old.Name())
+	}
+	h.adverts[service] = spool
+
+	r := bufio.NewReader(io.TeeReader(advert, spool))
+	for {
+		_, payload, err := readPkt(r)
+		if err != nil {
+			return fmt.Errorf("invalid advertisement: %w", err)
+		}
+		if payload == nil {
+			break
+		}
+
+		line := strings.TrimSuffix(string(payload), "\n")
+		ref, caps := line, ""
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			ref, caps = line[:i], line[i+1:]
+		}
+		for _, c := range strings.Fields(caps) {
+			if strings.HasPrefix(c, "symref=") {
+				if parts := strings.SplitN(strings.TrimPrefix(c, "symref="), ":", 2); len(parts) == 2 {
+					fmt.Fprintf(h.out, "@%s %s\n", parts[1], parts[0])
+				}
+			}
+		}
+		if strings.HasSuffix(ref, " capabilities^{}") {
+			continue
+		}
+		fmt.Fprintln(h.out, ref)
+	}
+	fmt.Fprintln(h.out)
+
+	// the rest of the advertisement, if any, is kept for fetch-pack or send-pack as well
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// statelessConnect proxies protocol v2 requests from git to the remote.
+// It reports whether the connection was established, as git falls back to 'list' and 'fetch' otherwise.
+func (h *Helper) statelessConnect(service string) (bool, error) {
+	if service != uploadPack {
+		fmt.Fprintln(h.out, "fallback")
+		return false, nil
+	}
+
+	advert, v2, err := h.discover(service, true)
+	if err != nil {
+		return false, err
+	}
+	defer advert.Close()
+	if !v2 {
+		log.Debug().Msgf("[Helper.statelessConnect] %s does not support protocol v2", h.URL.Redacted())
+		fmt.Fprintln(h.out, "fallback")
+		return false, nil
+	}
+	fmt.Fprintln(h.out)
+	if _, err := io.Copy(h.out, advert); err != nil {
+		return true, err
+	}
+
+	for {
+		// git closes stdin when it is done
+		if _, err := h.in.Peek(4); err == io.EOF {
+			return true, nil
+		}
+
+		req := newPktRequest(h.in, true)
+		resp, err := h.post(service, req, true)
+		if err != nil {
+			return true, err
+		}
+		_, err = io.Copy(h.out, resp)
+		resp.Close()
+		if err != nil {
+			return true, err
+		}
+		<-req.Done()
+		if err := req.Err(); err != nil {
+			return true, err
+		}
+		io.WriteString(h.out, responseEndPkt)
+	}
+}
+
+func (h *Helper) fetch(first string) error {
+	refs, err := h.readBatch("fetch", first)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"fetch-pack", "--stateless-rpc", "--stdin", "--lock-pack"}
+	if h.opts.thin {
+		args = append(args, "--thin")
+	}
+	if h.opts.followTags {
+		args = append(args, "--include-tag")
+	}
+	if h.opts.depth != "" {
+		args = append(args, "--depth="+h.opts.depth)
+	}
+	if h.opts.cloning {
+		args = append(args, "--cloning")
+	}
+	if h.opts.updateShallow {
+		args = append(args, "--update-shallow")
+	}
+	args = append(args, h.verbosityArgs(uploadPack)...)
+	args = append(args, h.URL.String())
+
+	var preamble bytes.Buffer
+	for _, ref := range refs {
+		writePkt(&preamble, ref+"\n")
+	}
+	preamble.WriteString(flushPkt)
+
+	// fetch-pack also prints the refs it fetched, which git does not expect from a remote-helper
+	err = h.rpc(uploadPack, args, preamble.Bytes(), func(line string) {
+		if strings.HasPrefix(line, "lock ") || line == "connectivity-ok" {
+			fmt.Fprintln(h.out, line)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(h.out)
+	return nil
+}
+
+func (h *Helper) push(first string) error {
+	specs, err := h.readBatch("push", first)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"send-pack", "--stateless-rpc", "--helper-status"}
+	if h.opts.thin {
+		args = append(args, "--thin")
+	}
+	if h.opts.dryRun {
+		args = append(args, "--dry-run")
+	}
+	if h.opts.atomic {
+		args = append(args, "--atomic")
+	}
+	for _, o := range h.opts.pushOptions {
+		args = append(args, "--push-option="+o)
+	}
+	args = append(args, h.verbosityArgs(receivePack)...)
+	args = append(args, h.URL.String(), "--stdin")
+
+	var preamble bytes.Buffer
+	for _, spec := range specs {
+		writePkt(&preamble, spec+"\n")
+	}
+	preamble.WriteString(flushPkt)
+
+	err = h.rpc(receivePack, args, preamble.Bytes(), func(line string) {
+		fmt.Fprintln(h.out, line)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(h.out)
+	return nil
+}
+
+// verbosityArgs translates the verbosity and progress options into arguments of fetch-pack or send-pack.
+func (h *Helper) verbosityArgs(service string) []string {
+	var args []string
+	switch {
+	case h.opts.verbosity <= 0:
+		args = append(args, "--quiet")
+	case h.opts.verbosity > 1:
+		args = append(args, "-v")
+	}
+	switch {
+	case service == uploadPack && !h.opts.progress:
+		args = append(args, "--no-progress")
+	case service == receivePack && h.opts.progress:
+		args = append(args, "--progress")
+	}
+	return args
+}
+
+// rpc runs a git command in '--stateless-rpc' mode, and sends each of its requests to the remote.
+// The command wraps each request in an extra layer of pkt-lines terminated by a flush packet,
+// and signals it is done with a lone flush packet, after which it prints its result, passed to result line by line.
+func (h *Helper) rpc(service string, args []string, preamble []byte, result func(line string)) error {
+	var advert io.Reader
+	if spool, ok := h.adverts[service]; ok {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		advert = spool
+	} else {
+		r, _, err := h.discover(service, false)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		advert = r
+	}
+
+	log.Debug().Msgf("[Helper.rpc] exec: git %v", args)
+	cmd := exec.Command(git.GitBinary, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	lines := 0
+	r := bufio.NewReader(stdout)
+	err = h.rpcLoop(service, stdin, r, io.MultiReader(bytes.NewReader(preamble), advert))
+	stdin.Close()
+	for err == nil {
+		var line string
+		line, err = r.ReadString('\n')
+		if line != "" {
+			result(strings.TrimSuffix(line, "\n"))
+			lines++
+		}
+		if err == io.EOF {
+			err = nil
+			break
+		}
+	}
+	// the result reports failures of individual refs, e.g. rejected pushes
+	if waitErr := cmd.Wait(); err == nil && waitErr != nil && lines == 0 {
+		err = fmt.Errorf("git %s failed: %w", args[0], waitErr)
+	}
+	return err
+}
+
+// rpcLoop sends the requests of a '--stateless-rpc' command to the remote, and their responses back to it,
+// until the command is done. Requests and responses are streamed.
+func (h *Helper) rpcLoop(service string, stdin io.Writer, stdout *bufio.Reader, preamble io.Reader) error {
+	if _, err := io.Copy(stdin, preamble); err != nil {
+		return err
+	}
+
+	for {
+		// the command prints its result right away when it has nothing to send (e.g. a rejected push)
+		header, err := stdout.Peek(4)
+		if err != nil || !isPktHeader(header) {
+			return nil
+		}
+		if string(header) == flushPkt {
+			// lone flush packet: the command is done
+			_, err := stdout.Discard(4)
+			return err
+		}
+
+		req := newPktRequest(stdout, false)
+		resp, err := h.post(service, req, false)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(stdin, resp)
+		resp.Close()
+		if err != nil {
+			return err
+		}
+		<-req.Done()
+		if err := req.Err(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// testHelperName is the name under which git runs the test binary as a remote-helper,
+	// for URLs like iaptest://127.0.0.1:<port>/repo.git.
+	testHelperName = "git-remote-iaptest"
+
+	// testTokensEnv lists the tokens handed out by the test remote-helper: each time IAP refuses one,
+	// the next one is used.
+	testTokensEnv = "IAPTEST_TOKENS"
+
+	validToken = "valid-token"
+)
+
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == testHelperName {
+		os.Exit(runTestHelper(os.Args[1], os.Args[2]))
+	}
+	os.Exit(m.Run())
+}
+
+// runTestHelper runs a Helper for an iaptest:// URL, over plain HTTP.
+func runTestHelper(remote, rawURL string) int {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	u.Scheme = "http"
+
+	tokens := &listSource{tokens: strings.Split(os.Getenv(testTokensEnv), ",")}
+	h := NewHelper(remote, u, iapauth.NewClient(tokens))
+	err = h.Run()
+	h.Close()
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return 1
+	}
+	return 0
+}
+
+// listSource hands out tokens from a list, moving to the next one when IAP refuses the current one.
+type listSource struct {
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (s *listSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &oauth2.Token{AccessToken: s.tokens[0]}, nil
+}
+
+func (s *listSource) Invalidate(*oauth2.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tokens) > 1 {
+		s.tokens = s.tokens[1:]
+	}
+}
+
+// An iapStandIn serves the repositories under a directory with 'git http-backend', and bounces requests
+// without a valid token to the Google sign-in page, like IAP.
+type iapStandIn struct {
+	URL string
+
+	mu      sync.Mutex
+	bounced int
+	chunked int
+	// params are appended to the Content-Type of the responses, e.g. "; charset=utf-8"
+	params string
+}
+
+// paramsWriter appends parameters to the Content-Type of a response.
+type paramsWriter struct {
+	http.ResponseWriter
+	params string
+}
+
+func (w *paramsWriter) WriteHeader(code int) {
+	if ct := w.Header().Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct+w.params)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// testEnv sets up a bare repository with a single commit behind an iapStandIn, and the environment
+// for git to run the test binary as the remote-helper of iaptest:// URLs.
+type testEnv struct {
+	t       *testing.T
+	dir     string
+	env     []string
+	standIn *iapStandIn
+}
+
+func newTestEnv(t *testing.T, tokens ...string) *testEnv {
+	t.Helper()
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	execPath, err := exec.Command(gitPath, "--exec-path").Output()
+	if err != nil {
+		t.Skipf("Could not find the exec path of git: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend")); err != nil {
+		t.Skip("git http-backend is not installed")
+	}
+
+	e := &testEnv{t: t, dir: t.TempDir()}
+
+	bin := filepath.Join(e.dir, "bin")
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(bin, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(self, filepath.Join(bin, testHelperName)); err != nil {
+		t.Fatal(err)
+	}
+	e.env = append(os.Environ(),
+		"PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"HOME="+e.dir,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+		testTokensEnv+"="+strings.Join(tokens, ","),
+	)
+
+	e.git("", "init", "-q", "-b", "main", "seed")
+	e.write("seed/README", "hello\n")
+	e.git("seed", "add", "README")
+	e.git("seed", "commit", "-q", "-m", "initial")
+	e.git("", "clone", "-q", "--bare", "seed", "srv/repo.git")
+	e.git("srv/repo.git", "config", "http.receivepack", "true")
+
+	backend := &cgi.Handler{
+		Path:       gitPath,
+		Args:       []string{"http-backend"},
+		Env:        []string{"GIT_PROJECT_ROOT=" + filepath.Join(e.dir, "srv"), "GIT_HTTP_EXPORT_ALL=1"},
+		InheritEnv: []string{"PATH", "HOME", "GIT_CONFIG_NOSYSTEM"},
+	}
+	e.standIn = &iapStandIn{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(iapauth.DefaultHeader) != "Bearer "+validToken {
+			e.standIn.mu.Lock()
+			e.standIn.bounced++
+			e.standIn.mu.Unlock()
+			http.Redirect(w, r, "https://accounts.google.com/o/oauth2/v2/auth?client_id=test", http.StatusFound)
+			return
+		}
+
+		// streamed bodies are sent chunked, which net/http/cgi refuses, unlike the web servers in front of git
+		if r.ContentLength < 0 {
+			e.standIn.mu.Lock()
+			e.standIn.chunked++
+			e.standIn.mu.Unlock()
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body, r.ContentLength, r.TransferEncoding = ioutil.NopCloser(bytes.NewReader(body)), int64(len(body)), nil
+		}
+		e.standIn.mu.Lock()
+		params := e.standIn.params
+		e.standIn.mu.Unlock()
+		if params != "" {
+			w = &paramsWriter{ResponseWriter: w, params: params}
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	e.standIn.URL = strings.Replace(srv.URL, "http://", "iaptest://", 1) + "/repo.git"
+	return e
+}
+
+// run runs git in a directory relative to the test directory, and returns its combined output.
+func (e *testEnv) run(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = filepath.Join(e.dir, dir)
+	cmd.Env = e.env
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func (e *testEnv) git(dir string, args ...string) string {
+	e.t.Helper()
+	out, err := e.run(dir, args...)
+	if err != nil {
+		e.t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(out)
+}
+
+func (e *testEnv) write(path, content string) {
+	e.t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(e.dir, path), []byte(content), 0600); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+func TestHelperClone(t *testing.T) {
+	for _, version := range []string{"0", "2"} {
+		t.Run("protocol.version="+version, func(t *testing.T) {
+			// IAP refuses the first token, the helper retries with the next one
+			e := newTestEnv(t, "expired-token", validToken)
+			e.git("", "-c", "protocol.version="+version, "clone", "-q", e.standIn.URL, "clone")
+
+			got, err := ioutil.ReadFile(filepath.Join(e.dir, "clone", "README"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "hello\n" {
+				t.Errorf("README = %q, want %q", got, "hello\n")
+			}
+			if e.standIn.bounced != 1 {
+				t.Errorf("IAP bounced %d requests, want 1", e.standIn.bounced)
+			}
+			if e.git("clone", "rev-parse", "HEAD") != e.git("srv/repo.git", "rev-parse", "main") {
+				t.Error("the clone is not at the commit of the remote")
+			}
+		})
+	}
+}
+
+func TestHelperContentTypeParameters(t *testing.T) {
+	// like git, the helper only compares the media type of the responses
+	e := newTestEnv(t, validToken)
+	e.standIn.mu.Lock()
+	e.standIn.params = "; charset=utf-8"
+	e.standIn.mu.Unlock()
+
+	e.git("", "clone", "-q", e.standIn.URL, "clone")
+	if e.git("clone", "rev-parse", "HEAD") != e.git("srv/repo.git", "rev-parse", "main") {
+		t.Error("the clone is not at the commit of the remote")
+	}
+}
+
+func TestHelperFetch(t *testing.T) {
+	e := newTestEnv(t, validToken)
+	e.git("", "clone", "-q", e.standIn.URL, "clone")
+
+	e.write("seed/README", "hello again\n")
+	e.git("seed", "commit", "-q", "-am", "second")
+	e.git("seed", "push", "-q", filepath.Join(e.dir, "srv/repo.git"), "main")
+
+	e.git("clone", "fetch", "-q", "origin")
+	if e.git("clone", "rev-parse", "origin/main") != e.git("seed", "rev-parse", "main") {
+		t.Error("fetch did not get the new commit")
+	}
+}
+
+func TestHelperPush(t *testing.T) {
+	e := newTestEnv(t, validToken)
+	e.git("", "clone", "-q", e.standIn.URL, "clone")
+
+	// a large incompressible file makes a pack larger than iapauth.MaxReplayBody, which is streamed
+	large := make([]byte, 3*iapauth.MaxReplayBody)
+	if _, err := rand.Read(large); err != nil {
+		t.Fatal(err)
+	}
+	e.write("clone/large.bin", string(large))
+	e.write("clone/README", "pushed\n")
+	e.git("clone", "add", "large.bin", "README")
+	e.git("clone", "commit", "-q", "-m", "push")
+	e.git("clone", "push", "-q", "origin", "main")
+
+	if e.git("srv/repo.git", "rev-parse", "main") != e.git("clone", "rev-parse", "HEAD") {
+		t.Fatal("the remote is not at the pushed commit")
+	}
+	if size := e.git("srv/repo.git", "cat-file", "-s", "main:large.bin"); size != strconv.Itoa(len(large)) {
+		t.Errorf("large.bin is %s bytes on the remote, want %d", size, len(large))
+	}
+	if e.standIn.chunked == 0 {
+		t.Error("the pack was not streamed")
+	}
+}
+
+func TestHelperRejectedPush(t *testing.T) {
+	e := newTestEnv(t, validToken)
+	e.git("", "clone", "-q", e.standIn.URL, "clone")
+
+	e.write("seed/README", "diverged\n")
+	e.git("seed", "commit", "-q", "-am", "diverged")
+	e.git("seed", "push", "-q", filepath.Join(e.dir, "srv/repo.git"), "main")
+
+	e.write("clone/README", "pushed\n")
+	e.git("clone", "commit", "-q", "-am", "push")
+	out, err := e.run("clone", "push", "origin", "main")
+	if err == nil {
+		t.Fatal("push of a diverged branch should fail")
+	}
+	if !strings.Contains(out, "rejected") {
+		t.Errorf("push output does not report the rejected ref:\n%s", out)
+	}
+}
+
+func TestHelperRefusedToken(t *testing.T) {
+	e := newTestEnv(t, "expired-token")
+	out, err := e.run("", "clone", e.standIn.URL, "clone")
+	if err == nil {
+		t.Fatal("clone with a token refused by IAP should fail")
+	}
+	if !strings.Contains(out, "IAP refused the token") {
+		t.Errorf("clone output does not explain the failure:\n%s", out)
+	}
+}
@@ -0,0 +1,149 @@
+package remote
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// pkt-line special packets.
+// see: https://git-scm.com/docs/protocol-common#_pkt_line_format
+const (
+	flushPkt       = "0000"
+	delimPkt       = "0001"
+	responseEndPkt = "0002"
+
+	// maxPktLen is the largest pkt-line allowed by the protocol, header included.
+	maxPktLen = 65520
+)
+
+// readPkt reads a single pkt-line. It returns the whole packet (header included),
+// its payload, and io.EOF when the stream ends cleanly.
+func readPkt(r *bufio.Reader) (raw, payload []byte, err error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	size, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid pkt-line header %q", header)
+	}
+	if size < 4 {
+		// flush, delim or response-end packet
+		return header, nil, nil
+	}
+	if size > maxPktLen {
+		return nil, nil, fmt.Errorf("pkt-line too long (%d)", size)
+	}
+
+	raw = make([]byte, size)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[4:]); err != nil {
+		return nil, nil, err
+	}
+	return raw, raw[4:], nil
+}
+
+// writePkt writes a payload as a pkt-line.
+func writePkt(w io.Writer, payload string) error {
+	_, err := fmt.Fprintf(w, "%04x%s", len(payload)+4, payload)
+	return err
+}
+
+// isPktHeader reports whether b starts with a pkt-line header.
+func isPktHeader(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	_, err := strconv.ParseUint(string(b[:4]), 16, 16)
+	return err == nil
+}
+
+// A pktRequest streams a request made of pkt-lines, up to the flush packet ending it, so that the request
+// can be sent while it is being read. With raw, packets are passed as is, flush packet included, as in
+// protocol v2. Otherwise only their payloads are, as when unwrapping the requests of '--stateless-rpc' commands.
+type pktRequest struct {
+	r   *bufio.Reader
+	raw bool
+
+	mu   sync.Mutex
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+func newPktRequest(r *bufio.Reader, raw bool) *pktRequest {
+	return &pktRequest{r: r, raw: raw, done: make(chan struct{})}
+}
+
+func (p *pktRequest) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.buf) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		p.next()
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// Close reads the rest of the request, so that the next one starts at the right place
+// even if the request was not sent in full.
+func (p *pktRequest) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.err == nil {
+		p.next()
+	}
+	p.buf = nil
+	return nil
+}
+
+// Done is closed once the whole request has been read.
+func (p *pktRequest) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns the error that ended the request early, if any.
+func (p *pktRequest) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err == io.EOF {
+		return nil
+	}
+	return p.err
+}
+
+// next reads a packet into buf, or records the end of the request.
+func (p *pktRequest) next() {
+	raw, payload, err := readPkt(p.r)
+	switch {
+	case err == io.EOF:
+		p.end(io.ErrUnexpectedEOF)
+	case err != nil:
+		p.end(err)
+	case string(raw) == flushPkt:
+		if p.raw {
+			p.buf = raw
+		}
+		p.end(io.EOF)
+	case p.raw:
+		p.buf = raw
+	default:
+		p.buf = payload
+	}
+}
+
+func (p *pktRequest) end(err error) {
+	p.err = err
+	close(p.done)
+}
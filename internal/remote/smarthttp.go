@@ -0,0 +1,134 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/adohkan/git-remote-https-iap/iapauth"
+	"github.com/adohkan/git-remote-https-iap/internal/log"
+)
+
+const (
+	uploadPack  = "git-upload-pack"
+	receivePack = "git-receive-pack"
+
+	protocolV2 = "version=2"
+)
+
+// discover fetches the advertisement of a service, and strips the '# service=' header of protocol v0.
+// It reports whether the server answered with protocol v2. The advertisement is streamed from the response,
+// which the caller must close.
+// see: https://git-scm.com/docs/http-protocol#_smart_clients
+func (h *Helper) discover(service string, v2 bool) (io.ReadCloser, bool, error) {
+	u := *h.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/info/refs"
+	u.RawQuery = "service=" + service
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if v2 {
+		req.Header.Set("Git-Protocol", protocolV2)
+	}
+
+	log.Debug().Msgf("[discover] GET %s", u.String())
+	resp, err := h.do(req, fmt.Sprintf("application/x-%s-advertisement", service))
+	if err != nil {
+		return nil, false, err
+	}
+
+	r := bufio.NewReader(resp)
+	raw, payload, err := readPkt(r)
+	if err != nil {
+		resp.Close()
+		return nil, false, fmt.Errorf("invalid advertisement from %s: %w", u.Redacted(), err)
+	}
+	if string(payload) == "version 2\n" {
+		return readCloser{io.MultiReader(bytes.NewReader(raw), r), resp}, true, nil
+	}
+	if string(payload) != fmt.Sprintf("# service=%s\n", service) {
+		resp.Close()
+		return nil, false, fmt.Errorf("invalid advertisement from %s: unexpected %q", u.Redacted(), payload)
+	}
+	if _, payload, err := readPkt(r); err != nil || payload != nil {
+		resp.Close()
+		return nil, false, fmt.Errorf("invalid advertisement from %s: missing flush after service header", u.Redacted())
+	}
+	return readCloser{r, resp}, false, nil
+}
+
+// post sends a request to a service, and returns the response body, which the caller must close.
+// Bodies of at most iapauth.MaxReplayBody are read in memory first, so that the request can be retried.
+func (h *Helper) post(service string, body io.ReadCloser, v2 bool) (io.ReadCloser, error) {
+	u := *h.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + service
+
+	head, err := ioutil.ReadAll(io.LimitReader(body, iapauth.MaxReplayBody+1))
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	var req *http.Request
+	if len(head) <= iapauth.MaxReplayBody {
+		body.Close()
+		req, err = http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(head))
+	} else {
+		req, err = http.NewRequest(http.MethodPost, u.String(), readCloser{io.MultiReader(bytes.NewReader(head), body), body})
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", fmt.Sprintf("application/x-%s-request", service))
+	req.Header.Set("Accept", fmt.Sprintf("application/x-%s-result", service))
+	if v2 {
+		req.Header.Set("Git-Protocol", protocolV2)
+	}
+
+	if req.GetBody != nil {
+		log.Debug().Msgf("[post] POST %s (%d bytes)", u.String(), len(head))
+	} else {
+		log.Debug().Msgf("[post] POST %s (streamed)", u.String())
+	}
+	return h.do(req, fmt.Sprintf("application/x-%s-result", service))
+}
+
+// A readCloser reads from a Reader, and closes a Closer, e.g. a response body it wraps.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// do sends a request, and turns unexpected responses into errors users can act upon.
+// It returns the response body, which the caller must close.
+func (h *Helper) do(req *http.Request, contentType string) (io.ReadCloser, error) {
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access '%s': %w", req.URL.Redacted(), err)
+	}
+	// like git, parameters such as charset are ignored
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode == http.StatusOK && mediaType == contentType {
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+
+	switch {
+	case iapauth.IsIAPBounce(resp):
+		return nil, fmt.Errorf("unable to access '%s': IAP refused the token (HTTP %d), try 'git-remote-https+iap check --forcebrowser %s %s'", req.URL.Redacted(), resp.StatusCode, h.Remote, h.URL.Redacted())
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("unable to access '%s': access denied by IAP (HTTP 403), check that your account is allowed to access this resource", req.URL.Redacted())
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("repository '%s' not found", h.URL.Redacted())
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unable to access '%s': HTTP %d", req.URL.Redacted(), resp.StatusCode)
+	default:
+		return nil, fmt.Errorf("unable to access '%s': unexpected Content-Type '%s', only the smart HTTP protocol is supported", req.URL.Redacted(), resp.Header.Get("Content-Type"))
+	}
+}